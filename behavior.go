@@ -0,0 +1,59 @@
+package dorm
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+)
+
+// mixins whose behavior was registered by the application
+var registered = map[interface{}]bool{}
+
+// RegisterBehavior adds a behavior to the models composed of the
+// given mixin: its statements (triggers, mostly) are created upon
+// the table of every such model, alike the built-in behaviors.
+// <<Table>> within a statement is replaced by the table name.
+// Statements are in the sql of the database that dorm builds
+// upon. It must be called before BuildSchema, say from init
+func RegisterBehavior(mixin interface{}, statements ...string) {
+	obj := behaviorKey(mixin)
+	behave[obj] = statements
+	behavePostgres[obj] = statements
+}
+
+// RegisterDynamicBehavior is RegisterBehavior, with the statements
+// built from the model (for instance, from its struct tags)
+func RegisterDynamicBehavior(mixin interface{}, fn func(model interface{}) []string) {
+	if fn == nil {
+		panic("dorm: behavior function is nil")
+	}
+	obj := behaviorKey(mixin)
+	dynamic := func(_ *gorm.DB, model interface{}) []string {
+		return fn(model)
+	}
+	behaveModel[obj] = dynamic
+	behaveModelPostgres[obj] = dynamic
+}
+
+// behaviorKey returns the (zero) value of the mixin, by which its
+// behavior is looked up. A mixin is a named struct that models
+// embed, and may not be one of dorm's own behaviors
+func behaviorKey(mixin interface{}) interface{} {
+	t := reflect.TypeOf(mixin)
+	if t == nil || t.Kind() != reflect.Struct || t.Name() == "" {
+		panic(fmt.Sprintf("dorm: behavior mixin must be a named struct, got %v", t))
+	}
+	if !t.Comparable() {
+		panic("dorm: behavior mixin must be comparable: " + t.Name())
+	}
+
+	obj := reflect.Zero(t).Interface()
+	_, static := behave[obj]
+	_, dynamic := behaveModel[obj]
+	if (static || dynamic) && !registered[obj] {
+		panic("dorm: cannot register a behavior upon dorm's own " + t.Name())
+	}
+	registered[obj] = true
+	return obj
+}
@@ -0,0 +1,33 @@
+package dorm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type published struct {
+	PublishedAt *string `sql:"null" json:"published_at"`
+}
+
+type article struct {
+	PKey
+	UID8
+	published
+}
+
+func TestRegisterBehavior(t *testing.T) {
+	RegisterBehavior(published{}, "CREATE TRIGGER <<Table>>_published BEFORE UPDATE ON <<Table>> FOR EACH ROW SET NEW.published_at = NOW()")
+	defer delete(behave, published{})
+	defer delete(behavePostgres, published{})
+	defer delete(registered, published{})
+
+	// applied in declaration order, after UID8
+	stmts := behaviorStatements(mysqlSQL{}, nil, article{})
+	assert.Len(t, stmts, len(behave[UID8{}])+1)
+	assert.Equal(t, "CREATE TRIGGER article_published BEFORE UPDATE ON article FOR EACH ROW SET NEW.published_at = NOW()", stmts[len(stmts)-1])
+
+	assert.Panics(t, func() { RegisterBehavior(Timed{}) })
+	assert.Panics(t, func() { RegisterBehavior(&published{}) })
+	assert.Panics(t, func() { RegisterDynamicBehavior(published{}, nil) })
+}
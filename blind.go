@@ -0,0 +1,247 @@
+package dorm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/fig"
+	"github.com/rightjoin/rutl/conv"
+	"github.com/rightjoin/rutl/refl"
+	"github.com/rs/zerolog/log"
+)
+
+// BlindKeyring is a Keyring that holds the key of blind indexes
+// as well. Unlike the keys of encryption, it can not be rotated
+// without rebuilding the blind indexes
+type BlindKeyring interface {
+	BlindKey() ([]byte, error)
+}
+
+// ErrNoBlindKey is returned when a blind index is computed,
+// but Keys holds no blind key
+var ErrNoBlindKey = errors.New("no key for blind index")
+
+func (k StaticKeyring) BlindKey() ([]byte, error) {
+	if len(k.Blind) == 0 {
+		return nil, ErrNoBlindKey
+	}
+	return k.Blind, nil
+}
+
+// blindIndex is a field with a blind index: an hmac of its
+// value, kept in a companion column that can be searched
+type blindIndex struct {
+	Column    string
+	Companion string
+	Lower     bool
+}
+
+// blindIndexes returns the fields of the model tagged with
+// blind_index, which names the companion column (true stands
+// for <column>_bidx) and may be followed by the lower option,
+// to match values regardless of case:
+// Email string `encrypt:"true" blind_index:"true;lower"`
+// EmailBidx *string `sql:"TYPE:char(64)" json:"-" index:"true" insert:"no" update:"no"`
+// The model must declare the companion column
+func blindIndexes(model interface{}) ([]blindIndex, error) {
+	out := []blindIndex{}
+	fields := map[string]bool{}
+	for _, fld := range refl.NestedFields(model) {
+		fields[conv.CaseSnake(fld.Name)] = true
+	}
+
+	for _, fld := range refl.NestedFields(model) {
+		tag, ok := fld.Tag.Lookup("blind_index")
+		if !ok {
+			continue
+		}
+		col := conv.CaseSnake(fld.Name)
+		parts := strings.Split(tag, ";")
+		b := blindIndex{Column: col, Companion: strings.TrimSpace(parts[0])}
+		if b.Companion == "true" || b.Companion == "" {
+			b.Companion = col + "_bidx"
+		}
+		for _, opt := range parts[1:] {
+			switch strings.TrimSpace(opt) {
+			case "lower":
+				b.Lower = true
+			case "":
+			default:
+				return nil, fmt.Errorf("blind_index on %s.%s has unknown option: %s", Table(model), col, opt)
+			}
+		}
+		if !fields[b.Companion] {
+			return nil, fmt.Errorf("blind_index on %s.%s needs the column %s in the model", Table(model), col, b.Companion)
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// blindIndexOf returns the model's blind index of the column
+func blindIndexOf(model interface{}, column string) (blindIndex, bool, error) {
+	c := cryptOf(model)
+	if c.err != nil {
+		return blindIndex{}, false, c.err
+	}
+	for _, b := range c.blinds {
+		if b.Column == column {
+			return b, true, nil
+		}
+	}
+	return blindIndex{}, false, nil
+}
+
+// hash returns the blind index of the value: the hmac (sha256)
+// of the value, keyed by the blind key, and salted with the
+// table and column so that equal values of other columns differ
+func (b blindIndex) hash(tbl string, value string) (string, error) {
+	if Keys == nil {
+		return "", ErrNoKeyring
+	}
+	ring, ok := Keys.(BlindKeyring)
+	if !ok {
+		return "", ErrNoBlindKey
+	}
+	key, err := ring.BlindKey()
+	if err != nil {
+		return "", err
+	}
+
+	if b.Lower {
+		value = strings.ToLower(value)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(tbl + "." + b.Column + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// blindData sets the companion columns of the blind indexed
+// columns within the data, from their (plain) values
+func blindData(model interface{}, blinds []blindIndex, data map[string]string) error {
+	tbl := Table(model)
+	for _, b := range blinds {
+		val, ok := data[b.Column]
+		if !ok {
+			continue
+		}
+		if val == NullString {
+			data[b.Companion] = NullString
+			continue
+		}
+		h, err := b.hash(tbl, val)
+		if err != nil {
+			return fmt.Errorf("blind index %s.%s: %w", tbl, b.Column, err)
+		}
+		data[b.Companion] = h
+	}
+	return nil
+}
+
+// BlindWhere turns the lookup of a blind indexed column by its
+// value into a condition (and its parameter) upon the companion
+// column, for use with gorm:
+// where, arg, err := BlindWhere(&User{}, "email", email)
+// dbo.Where(where, arg).First(&user)
+func BlindWhere(model interface{}, column string, value string) (string, interface{}, error) {
+	b, ok, err := blindIndexOf(model, column)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		return "", nil, fmt.Errorf("no blind index on %s.%s", Table(model), column)
+	}
+	h, err := b.hash(Table(model), value)
+	if err != nil {
+		return "", nil, err
+	}
+	return b.Companion + " = ?", h, nil
+}
+
+// FindBlind loads into addr the row whose blind indexed column
+// has the given value, and decrypts it. gorm.ErrRecordNotFound
+// is returned if there is none
+func FindBlind(dbo *gorm.DB, addr interface{}, column string, value string) error {
+	where, arg, err := BlindWhere(addr, column, value)
+	if err != nil {
+		return err
+	}
+	if err = dbo.Where(where, arg).First(addr).Error; err != nil {
+		return err
+	}
+	return decryptModel(addr)
+}
+
+// ReindexBlind fills in the blind indexes of the model's rows
+// that have none, as those written before the field was tagged,
+// and returns the count of rows reindexed. Rows are reindexed
+// in batches of database.encrypt.batch (defaults to 500)
+func ReindexBlind(dbo *gorm.DB, model interface{}) (int, error) {
+	tbl := Table(model)
+	quote := dbo.Dialect().Quote
+
+	count := 0
+	batch := fig.IntOr(500, "database.encrypt.batch")
+	blinds, err := blindIndexes(model)
+	if err != nil {
+		return 0, err
+	}
+	for _, b := range blinds {
+		query := fmt.Sprintf("SELECT id, %s FROM %s WHERE id > ? AND %s IS NULL AND %s IS NOT NULL ORDER BY id LIMIT ?",
+			quote(b.Column), quote(tbl), quote(b.Companion), quote(b.Column))
+
+		var last uint64
+		for {
+			type row struct {
+				id  uint64
+				val string
+			}
+			found := []row{}
+			rows, err := dbo.Raw(query, last, batch).Rows()
+			if err != nil {
+				return count, err
+			}
+			for rows.Next() {
+				r := row{}
+				if err = rows.Scan(&r.id, &r.val); err != nil {
+					rows.Close()
+					return count, err
+				}
+				found = append(found, r)
+			}
+			rows.Close()
+
+			for _, r := range found {
+				plain, err := decryptValue(Keys, r.val)
+				if err != nil {
+					return count, fmt.Errorf("decrypt %s.%s of %d: %w", tbl, b.Column, r.id, err)
+				}
+				h, err := b.hash(tbl, plain)
+				if err != nil {
+					return count, err
+				}
+				err = dbo.Exec("UPDATE "+quote(tbl)+" SET "+quote(b.Companion)+" = ? WHERE id = ?", h, r.id).Error
+				if err != nil {
+					return count, err
+				}
+				count++
+			}
+
+			if len(found) < batch {
+				break
+			}
+			last = found[len(found)-1].id
+		}
+	}
+
+	log.Info().
+		Str("table", tbl).
+		Int("rows", count).
+		Msg("encrypt: blind indexes filled in")
+	return count, nil
+}
@@ -0,0 +1,70 @@
+package dorm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type member struct {
+	PKey
+	Email     string  `json:"email" encrypt:"true" blind_index:"true;lower"`
+	EmailBidx *string `sql:"TYPE:char(64)" json:"-" index:"true" insert:"no" update:"no"`
+	Phone     string  `json:"phone" blind_index:"phone_hash"`
+	PhoneHash *string `sql:"TYPE:char(64)" json:"-" insert:"no" update:"no"`
+}
+
+func TestBlindIndexes(t *testing.T) {
+	blinds, err := blindIndexes(member{})
+	assert.Nil(t, err)
+	assert.Equal(t, []blindIndex{
+		{Column: "email", Companion: "email_bidx", Lower: true},
+		{Column: "phone", Companion: "phone_hash"},
+	}, blinds)
+
+	// bad tags fail the schema build, and the writes
+	type orphan struct {
+		PKey
+		Email string `json:"email" blind_index:"true"`
+	}
+	type odd struct {
+		PKey
+		Email     string  `json:"email" blind_index:"true;upper"`
+		EmailBidx *string `json:"-"`
+	}
+	_, err = blindIndexes(orphan{})
+	assert.NotNil(t, err)
+	assert.NotNil(t, checkModel(&odd{}))
+	_, err = encryptData(&orphan{}, map[string]string{"email": "a@b.c"})
+	assert.NotNil(t, err)
+	_, _, err = BlindWhere(&odd{}, "email", "a@b.c")
+	assert.NotNil(t, err)
+}
+
+func TestBlindWhere(t *testing.T) {
+	ring := testKeyring("k1")
+	Keys = ring
+	defer func() { Keys = nil }()
+
+	_, _, err := BlindWhere(&member{}, "email", "ann@example.com")
+	assert.Equal(t, ErrNoBlindKey, err)
+
+	ring.Blind = bytes.Repeat([]byte{7}, 32)
+	Keys = ring
+
+	where, arg, err := BlindWhere(&member{}, "email", "Ann@Example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "email_bidx = ?", where)
+	assert.Len(t, arg, 64)
+
+	data, err := encryptData(&member{}, map[string]string{"email": "ann@example.com", "phone": "555"})
+	assert.Nil(t, err)
+	assert.Equal(t, arg, data["email_bidx"])
+	assert.NotEqual(t, "ann@example.com", data["email"])
+	assert.Equal(t, "555", data["phone"])
+	assert.Len(t, data["phone_hash"], 64)
+
+	_, _, err = BlindWhere(&member{}, "name", "ann")
+	assert.NotNil(t, err)
+}
@@ -1,7 +1,9 @@
 package dorm
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
@@ -232,16 +234,38 @@ func doInsertion(txn *gorm.DB, addr interface{}, data map[string]string, doRead
 	// get table name
 	table := Table(addr)
 
-	// ensure that "who" values have been attached from request
+	// ensure that "who" values have been attached from request,
+	// or else from the handle
+	attachWho(txn, addr, data)
 	if refl.ComposedOf(addr, WhosThat{}) {
 		if _, ok := data["who"]; !ok {
 			return fmt.Errorf("insert data missing 'who' content")
 		}
 	}
 
+	// rows of Tenanted models belong to the handle's tenant
+	if refl.ComposedOf(addr, Tenanted{}) {
+		tenant, ok := TenantOf(txn)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrNoTenant, table)
+		}
+		data["tenant_id"] = tenant
+	}
+
+	// uids that are generated by dorm, rather than a trigger
+	if err := assignUID(addr, data); err != nil {
+		return err
+	}
+
+	data, err := encryptData(addr, data)
+	if err != nil {
+		return err
+	}
+
 	// send insert to db
-	sql, params := buildInsertSql(table, data)
-	err := txn.Exec(sql, params...).Error
+	quote := txn.Dialect().Quote
+	sql, params := buildInsertSql(quote, table, data)
+	err = txn.Exec(sql, params...).Error
 	if err != nil {
 		return err
 	}
@@ -254,20 +278,29 @@ func doInsertion(txn *gorm.DB, addr interface{}, data map[string]string, doRead
 	}
 
 	if doRead {
-		// fetch primary key value
-		var pid int
-		row := txn.Raw("SELECT LAST_INSERT_ID()").Row()
-		err = row.Scan(&pid)
-		if err != nil {
-			return err
+		// fetch primary key value, unless it was given
+		var pid interface{}
+		if id, ok := data["id"]; ok {
+			pid = id
+		} else {
+			var last int
+			row := txn.Raw(dialectOf(txn).lastInsertID()).Row()
+			err = row.Scan(&last)
+			if err != nil {
+				return err
+			}
+			pid = last
 		}
 
 		// select record
 		//err = txn.Where("id=?", pid).Find(addr).Error
-		err = txn.Raw("SELECT * FROM "+Table(addr)+" WHERE id=?", pid).Scan(addr).Error
+		err = txn.Raw("SELECT * FROM "+quote(table)+" WHERE id=?", pid).Scan(addr).Error
 		if err != nil {
 			return err
 		}
+		if err = decryptModel(addr); err != nil {
+			return err
+		}
 
 		// invoke PreCommit validations
 		if found {
@@ -286,21 +319,80 @@ func doUpdation(txn *gorm.DB, pkField string, pkValue interface{}, addr interfac
 	// get table name
 	table := Table(addr)
 
-	// ensure that "who" values have been attached from request
+	// ensure that "who" values have been attached from request,
+	// or else from the handle
+	attachWho(txn, addr, data)
 	if refl.ComposedOf(addr, WhosThat{}) {
 		if _, ok := data["who"]; !ok {
 			return fmt.Errorf("update data missing 'who' content")
 		}
 	}
 
-	// send update to db
-	sql, params := buildUpdateSql(table, pkField, pkValue, data)
-	fmt.Println("sql:", sql)
-	err := txn.Exec(sql, params...).Error
+	// rows of Tenanted models are only updated for the handle's tenant
+	tenant, tenantParams, err := tenantWhere(txn, addr)
 	if err != nil {
 		return err
 	}
 
+	// versioned rows are only updated at the expected version
+	expect, versioned := "", false
+	if refl.ComposedOf(addr, Versioned{}) {
+		expect, versioned = data["version"]
+	}
+	if versioned {
+		rest := make(map[string]string, len(data))
+		for k, v := range data {
+			if k != "version" {
+				rest[k] = v
+			}
+		}
+		data = rest
+	}
+
+	data, err = encryptData(addr, data)
+	if err != nil {
+		return err
+	}
+
+	// send update to db, unless the data holds
+	// nothing but the version to check
+	quote := txn.Dialect().Quote
+	affected := int64(0)
+	if !versioned || len(data) > 0 {
+		stmt, params := buildUpdateSql(quote, table, pkField, pkValue, data)
+		if versioned {
+			stmt += " AND " + quote("version") + " = ?"
+			params = append(params, expect)
+		}
+		stmt += tenant
+		params = append(params, tenantParams...)
+		res := txn.Exec(stmt, params...)
+		if res.Error != nil {
+			return res.Error
+		}
+		affected = res.RowsAffected
+	}
+
+	// tell a row at another version from a missing one (or
+	// one of another tenant, or one left as it was by mysql)
+	if (versioned || tenant != "") && affected == 0 {
+		col := pkField
+		if versioned {
+			col = "version"
+		}
+		var current string
+		row := txn.Raw("SELECT "+quote(col)+" FROM "+quote(table)+" WHERE "+quote(pkField)+" = ?"+tenant, append([]interface{}{pkValue}, tenantParams...)...).Row()
+		if err = row.Scan(&current); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return gorm.ErrRecordNotFound
+			}
+			return err
+		}
+		if versioned && current != expect {
+			return fmt.Errorf("%w: %s %v is at version %s, not %s", ErrStaleVersion, table, pkValue, current, expect)
+		}
+	}
+
 	// does model have PreCommit validation
 	v := reflect.ValueOf(addr).Elem()
 	_, found := v.Interface().(hookCommit)
@@ -309,11 +401,14 @@ func doUpdation(txn *gorm.DB, pkField string, pkValue interface{}, addr interfac
 	}
 
 	if doRead {
-		// select record
+		// select record (of the tenant, by the gorm callback)
 		err = txn.Where(pkField+"=?", pkValue).Find(addr).Error
 		if err != nil {
 			return err
 		}
+		if err = decryptModel(addr); err != nil {
+			return err
+		}
 
 		// invoke PreCommit validations
 		if found {
@@ -327,7 +422,7 @@ func doUpdation(txn *gorm.DB, pkField string, pkValue interface{}, addr interfac
 	return nil
 }
 
-func buildInsertSql(tbl string, inp map[string]string) (string, []interface{}) {
+func buildInsertSql(quote func(string) string, tbl string, inp map[string]string) (string, []interface{}) {
 
 	// TODO: optimize string concatenation
 
@@ -338,32 +433,28 @@ func buildInsertSql(tbl string, inp map[string]string) (string, []interface{}) {
 	for key, val := range inp {
 		if val == NullString { // null check
 			if keys == "" {
-				keys = fmt.Sprintf("`%s`", key)
+				keys = quote(key)
 				vals = "NULL"
 			} else {
-				keys += fmt.Sprintf(", `%s`", key)
+				keys += ", " + quote(key)
 				vals += ", NULL"
 			}
 		} else {
 			if keys == "" {
-				keys = fmt.Sprintf("`%s`", key)
+				keys = quote(key)
 				vals = "?"
 			} else {
-				keys += fmt.Sprintf(", `%s`", key)
+				keys += ", " + quote(key)
 				vals += ", ?"
 			}
-			if EncryptColumn != nil {
-				val = EncryptColumn(tbl, key, val)
-			}
 			params = append(params, val)
 		}
 	}
-	fmt.Println(fmt.Sprintf("INSERT INTO `%s` (%s) VALUES (%s)", tbl, keys, vals), params)
 
-	return fmt.Sprintf("INSERT INTO `%s` (%s) VALUES (%s)", tbl, keys, vals), params
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quote(tbl), keys, vals), params
 }
 
-func buildUpdateSql(tbl string, pkField string, pkValue interface{}, inp map[string]string) (string, []interface{}) {
+func buildUpdateSql(quote func(string) string, tbl string, pkField string, pkValue interface{}, inp map[string]string) (string, []interface{}) {
 
 	params := make([]interface{}, 0)
 
@@ -371,18 +462,15 @@ func buildUpdateSql(tbl string, pkField string, pkValue interface{}, inp map[str
 	for key, val := range inp {
 		if val == NullString { // null check
 			if upd == "" {
-				upd = fmt.Sprintf("`%s`=NULL", key)
+				upd = quote(key) + "=NULL"
 			} else {
-				upd += fmt.Sprintf(", `%s`=NULL", key)
+				upd += ", " + quote(key) + "=NULL"
 			}
 		} else {
 			if upd == "" {
-				upd = fmt.Sprintf("`%s`=?", key)
+				upd = quote(key) + "=?"
 			} else {
-				upd += fmt.Sprintf(", `%s`=?", key)
-			}
-			if EncryptColumn != nil {
-				val = EncryptColumn(tbl, key, val)
+				upd += ", " + quote(key) + "=?"
 			}
 			params = append(params, val)
 		}
@@ -391,9 +479,18 @@ func buildUpdateSql(tbl string, pkField string, pkValue interface{}, inp map[str
 	// add search criterion at the end
 	params = append(params, pkValue)
 
-	return fmt.Sprintf("UPDATE `%s` SET %s WHERE `%s` = ?", tbl, upd, pkField), params
+	return fmt.Sprintf("UPDATE %s SET %s WHERE %s = ?", quote(tbl), upd, quote(pkField)), params
 }
 
+// ErrStaleVersion is returned when a Versioned row is updated
+// at a version other than its current one
+var ErrStaleVersion = errors.New("row has changed since it was read")
+
+// EncryptColumn (if set) encrypts the values written by Insert
+// and Update, but for those of columns tagged encrypt:"true" and
+// those that dorm sets (version, tenant_id and blind indexes)
+//
+// Deprecated: tag the fields encrypt:"true" instead
 var EncryptColumn func(tbl string, field string, value string) (encrpValue string)
 
 type hookCommit interface {
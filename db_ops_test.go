@@ -1,8 +1,11 @@
 package dorm
 
 import (
+	"database/sql/driver"
+	"errors"
 	"testing"
 
+	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -11,10 +14,13 @@ func TestBuildInsertSql(t *testing.T) {
 		"field": "value",
 	}
 
-	sql, params := buildInsertSql("table_name", vars)
+	sql, params := buildInsertSql(mysqlQuote, "table_name", vars)
 
 	assert.Equal(t, "INSERT INTO `table_name` (`field`) VALUES (?)", sql)
 	assert.Equal(t, "value", params[0])
+
+	sql, _ = buildInsertSql(pgQuote, "table_name", vars)
+	assert.Equal(t, `INSERT INTO "table_name" ("field") VALUES (?)`, sql)
 }
 
 func TestBuildUpdateSql(t *testing.T) {
@@ -22,11 +28,52 @@ func TestBuildUpdateSql(t *testing.T) {
 		"field": "value",
 	}
 
-	sql, params := buildUpdateSql("table_name", "id", 12345, vars)
+	sql, params := buildUpdateSql(mysqlQuote, "table_name", "id", 12345, vars)
 
 	assert.Equal(t, "UPDATE `table_name` SET `field`=? WHERE `id` = ?", sql)
 	assert.Equal(t, "value", params[0])
 	assert.Equal(t, 12345, params[1])
+
+	sql, _ = buildUpdateSql(pgQuote, "table_name", "id", 12345, vars)
+	assert.Equal(t, `UPDATE "table_name" SET "field"=? WHERE "id" = ?`, sql)
+}
+
+type ledger struct {
+	PKey
+	Title string `sql:"TYPE:varchar(64)" json:"title"`
+	Versioned
+}
+
+func TestVersionedUpdate(t *testing.T) {
+	dbo, f := newFakeDB(t)
+	assert.Nil(t, Update(dbo, "id", 7, &ledger{}, "title", "b", "version", 2))
+	stmt, args, _ := f.find("UPDATE")
+	assert.Equal(t, "UPDATE `ledger` SET `title`=? WHERE `id` = ? AND `version` = ?", stmt)
+	assert.Equal(t, []driver.Value{"b", int64(7), "2"}, args)
+
+	// a row at another version is stale
+	dbo, f = newFakeDB(t)
+	f.on("UPDATE", fakeReply{affected: 0})
+	f.on("SELECT `version`", fakeReply{cols: []string{"version"}, rows: [][]driver.Value{{"3"}}})
+	err := Update(dbo, "id", 7, &ledger{}, "title", "b", "version", 2)
+	assert.True(t, errors.Is(err, ErrStaleVersion), err)
+	stmt, _, _ = f.find("SELECT")
+	assert.Contains(t, stmt, "SELECT `version` FROM `ledger` WHERE `id` = ?")
+
+	// while a missing row is not found
+	dbo, f = newFakeDB(t)
+	f.on("UPDATE", fakeReply{affected: 0})
+	err = Update(dbo, "id", 7, &ledger{}, "title", "b", "version", 2)
+	assert.Equal(t, gorm.ErrRecordNotFound, err)
+
+	// data of the version alone is only checked
+	dbo, f = newFakeDB(t)
+	f.on("SELECT `version`", fakeReply{cols: []string{"version"}, rows: [][]driver.Value{{"2"}}})
+	assert.Nil(t, Update(dbo, "id", 7, &ledger{}, "version", 2))
+	_, _, ok := f.find("UPDATE")
+	assert.False(t, ok)
+	err = Update(dbo, "id", 7, &ledger{}, "version", 1)
+	assert.True(t, errors.Is(err, ErrStaleVersion), err)
 }
 
 func TestPrepareData(t *testing.T) {
@@ -0,0 +1,299 @@
+package dorm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// sqlDialect generates the database specific sql of a schema
+// build: behaviors, stored functions, history tables and the
+// reading of live indexes and keys. Mysql is the default
+type sqlDialect interface {
+	// behaviors returns the static and the dynamic behaviors
+	behaviors() (map[interface{}][]string, map[interface{}]dynamicBehavior)
+
+	// functions returns the stored functions behaviors rely upon
+	functions() []sqlFunction
+
+	hasTrigger(dbo *gorm.DB, name string) bool
+	hasFunction(dbo *gorm.DB, name string) bool
+	dropTrigger(name string, table string) string
+	dropFunction(name string) string
+
+	// upsert inserts the values, or updates the given
+	// columns of the row that has the same unique key
+	upsert(table string, cols []string, vals []string, keys []string, update []string) string
+
+	// columns returns the columns of the table, as by SHOW COLUMNS
+	columns(dbo *gorm.DB, table string) ([]showColumn, error)
+
+	createHistory(tbl string, hist string, cols []showColumn) []string
+	syncHistory(hist string, cols []showColumn, have []showColumn) []string
+	auditTriggers(tbl string, cols []string) []string
+
+	// createArchive creates the archive table alike the history
+	// table, with its primary key on row_id
+	createArchive(arch string, hist string) string
+	addArchiveColumn(arch string, c showColumn) string
+
+	// archiveRows copies the rows of the ids (a parameter) from the
+	// history table, skipping those archived already
+	archiveRows(arch string, hist string, cols []string) string
+
+	// indexName returns the name an index is created with
+	indexName(tbl string, name string) string
+	liveIndexes(dbo *gorm.DB, tbl string) (map[string]indexDef, []string)
+	createIndex(tbl string, idx indexDef) string
+	dropIndex(tbl string, name string) string
+
+	liveForeignKeys(dbo *gorm.DB, tbl string) (map[string]foreignKeyDef, []string)
+
+	// referencedBy returns the tables with foreign keys to tbl
+	referencedBy(dbo *gorm.DB, tbl string) []string
+	dropForeignKey(tbl string, name string) string
+
+	// softCascade returns the trigger upon the referenced table,
+	// that soft deletes (and restores) the rows of tbl with it
+	softCascade(tbl string, fk foreignKeyDef) string
+
+	// purge lets the session delete rows of SoftDelete
+	// models, which their trigger blocks otherwise. On
+	// postgres it only holds within a transaction
+	purge(allow bool) string
+
+	// rotate lets the session rewrite rows (as RotateKeys
+	// does) without the triggers of history, version and
+	// timestamps. On postgres it only holds within a transaction
+	rotate(on bool) string
+
+	// lastInsertID returns the id generated by the
+	// last insert of the session
+	lastInsertID() string
+
+	// ago returns the instant a number of seconds (a parameter)
+	// before now, by the clock of the database
+	ago() string
+}
+
+// sqlFunction is a stored function, and its definition
+type sqlFunction struct {
+	name string
+	sql  string
+}
+
+// dialectOf returns the sql dialect of the connection
+func dialectOf(dbo *gorm.DB) sqlDialect {
+	if dbo != nil && dbo.Dialect().GetName() == "postgres" {
+		return postgresSQL{}
+	}
+	return mysqlSQL{}
+}
+
+type mysqlSQL struct{}
+
+func (mysqlSQL) behaviors() (map[interface{}][]string, map[interface{}]dynamicBehavior) {
+	return behave, behaveModel
+}
+
+func (mysqlSQL) functions() []sqlFunction {
+	return mysqlFunctions
+}
+
+func (mysqlSQL) hasTrigger(dbo *gorm.DB, name string) bool {
+	var count int
+	dbo.Raw("SELECT count(*) FROM INFORMATION_SCHEMA.TRIGGERS WHERE TRIGGER_SCHEMA = DATABASE() AND TRIGGER_NAME = ?", name).Row().Scan(&count)
+	return count > 0
+}
+
+func (mysqlSQL) hasFunction(dbo *gorm.DB, name string) bool {
+	var count int
+	dbo.Raw("SELECT count(*) FROM INFORMATION_SCHEMA.ROUTINES WHERE ROUTINE_SCHEMA = DATABASE() AND ROUTINE_TYPE = 'FUNCTION' AND ROUTINE_NAME = ?", name).Row().Scan(&count)
+	return count > 0
+}
+
+// mysql trigger names are unique within the database
+func (mysqlSQL) dropTrigger(name string, table string) string {
+	return "DROP TRIGGER IF EXISTS " + name
+}
+
+func (mysqlSQL) dropFunction(name string) string {
+	return "DROP FUNCTION IF EXISTS " + name
+}
+
+func (mysqlSQL) upsert(table string, cols []string, vals []string, keys []string, update []string) string {
+	set := make([]string, len(update))
+	for i, c := range update {
+		set[i] = c + " = VALUES(" + c + ")"
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE %s", table, strings.Join(cols, ", "), strings.Join(vals, ", "), strings.Join(set, ", "))
+}
+
+func (mysqlSQL) columns(dbo *gorm.DB, table string) ([]showColumn, error) {
+	return showColumns(dbo, table, "1 = 1")
+}
+
+func (mysqlSQL) createHistory(tbl string, hist string, cols []showColumn) []string {
+	return mysqlCreateHistory(tbl, hist, cols)
+}
+
+func (mysqlSQL) syncHistory(hist string, cols []showColumn, have []showColumn) []string {
+	return mysqlSyncHistory(hist, cols, have)
+}
+
+func (mysqlSQL) auditTriggers(tbl string, cols []string) []string {
+	return mysqlAuditTriggers(tbl, cols)
+}
+
+func (mysqlSQL) createArchive(arch string, hist string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s LIKE %s", mysqlQuote(arch), mysqlQuote(hist))
+}
+
+func (mysqlSQL) addArchiveColumn(arch string, c showColumn) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", mysqlQuote(arch), c.historyDefinition())
+}
+
+func (mysqlSQL) archiveRows(arch string, hist string, cols []string) string {
+	list := make([]string, len(cols))
+	for i, c := range cols {
+		list[i] = mysqlQuote(c)
+	}
+	return fmt.Sprintf("INSERT IGNORE INTO %s (%s) SELECT %s FROM %s WHERE row_id IN (?)", mysqlQuote(arch), strings.Join(list, ", "), strings.Join(list, ", "), mysqlQuote(hist))
+}
+
+// mysql index names are unique within the table
+func (mysqlSQL) indexName(tbl string, name string) string {
+	return name
+}
+
+func (mysqlSQL) liveIndexes(dbo *gorm.DB, tbl string) (map[string]indexDef, []string) {
+	return liveIndexes(dbo, tbl)
+}
+
+func (mysqlSQL) createIndex(tbl string, idx indexDef) string {
+	return idx.create(mysqlQuote, tbl)
+}
+
+func (mysqlSQL) dropIndex(tbl string, name string) string {
+	return fmt.Sprintf("DROP INDEX %v ON %v", name, mysqlQuote(tbl))
+}
+
+func (mysqlSQL) liveForeignKeys(dbo *gorm.DB, tbl string) (map[string]foreignKeyDef, []string) {
+	return liveForeignKeys(dbo, tbl)
+}
+
+func (mysqlSQL) referencedBy(dbo *gorm.DB, tbl string) []string {
+	var tables []string
+	err := dbo.Raw("SELECT DISTINCT TABLE_NAME FROM INFORMATION_SCHEMA.KEY_COLUMN_USAGE WHERE TABLE_SCHEMA = DATABASE() AND REFERENCED_TABLE_NAME = ? ORDER BY TABLE_NAME", tbl).Pluck("TABLE_NAME", &tables).Error
+	if err != nil {
+		panic(err)
+	}
+	return tables
+}
+
+// softCascade restores the rows that were deleted along with
+// the referenced row, but not those deleted ahead of it. The
+// rows' own trigger sets their deleted_at
+func (mysqlSQL) softCascade(tbl string, fk foreignKeyDef) string {
+	match := make([]string, len(fk.Columns))
+	for i := range fk.Columns {
+		match[i] = fmt.Sprintf("%s = NEW.%s", mysqlQuote(fk.Columns[i]), mysqlQuote(fk.RefColumns[i]))
+	}
+	where := strings.Join(match, " AND ")
+
+	return fmt.Sprintf(`CREATE TRIGGER %s AFTER UPDATE ON %s FOR EACH ROW
+		BEGIN
+			IF OLD.deleted = 0 AND NEW.deleted = 1 THEN
+				UPDATE %s SET deleted = 1 WHERE %s AND deleted = 0;
+			ELSEIF OLD.deleted = 1 AND NEW.deleted = 0 THEN
+				UPDATE %s SET deleted = 0 WHERE %s AND deleted = 1 AND deleted_at >= OLD.deleted_at - INTERVAL 1 SECOND;
+			END IF;
+		END`, softCascadeName(tbl, fk), mysqlQuote(fk.RefTable), mysqlQuote(tbl), where, mysqlQuote(tbl), where)
+}
+
+func (mysqlSQL) purge(allow bool) string {
+	if allow {
+		return "SET @dorm_purge = 1"
+	}
+	return "SET @dorm_purge = NULL"
+}
+
+func (mysqlSQL) rotate(on bool) string {
+	if on {
+		return "SET @dorm_rotate = 1"
+	}
+	return "SET @dorm_rotate = NULL"
+}
+
+func (mysqlSQL) lastInsertID() string {
+	return "SELECT LAST_INSERT_ID()"
+}
+
+func (mysqlSQL) ago() string {
+	return "NOW() - INTERVAL ? SECOND"
+}
+
+func (mysqlSQL) dropForeignKey(tbl string, name string) string {
+	return fmt.Sprintf("ALTER TABLE %s DROP FOREIGN KEY %s;", mysqlQuote(tbl), mysqlQuote(name))
+}
+
+func mysqlQuote(key string) string {
+	return "`" + key + "`"
+}
+
+// mysqlFunctions are the stored functions that behaviors
+// depend upon. CreateDatabase creates them, and
+// BuildSchema keeps them current
+var mysqlFunctions = []sqlFunction{
+	// function: url cleanup
+	{"geturl", `CREATE FUNCTION geturl( str VARCHAR(256) ) RETURNS VARCHAR(256)
+	DETERMINISTIC
+	READS SQL DATA
+	BEGIN
+		DECLARE i, len SMALLINT DEFAULT 1;
+		DECLARE ret VARCHAR(256) DEFAULT '';
+		DECLARE c VARCHAR(1);
+		DECLARE prev VARCHAR(1);
+
+		SET str = LCASE(TRIM(str));
+		SET len = CHAR_LENGTH(str);
+
+		REPEAT
+			BEGIN
+				SET c = MID( str, i, 1 );
+				IF c REGEXP '[[:alnum:]]' OR c IN ('-','_',' ') THEN
+					IF c = ' ' THEN
+						SET c = '-';
+					END IF;
+					IF prev = '-' AND c = '-' THEN
+						# do nothing
+						SET c = '-';
+					ELSE
+						SET ret=CONCAT(ret,c);
+					END IF;
+					SET prev = c;
+				END IF;
+				SET i = i + 1;
+			END;
+		UNTIL i > len END REPEAT;
+		RETURN ret;
+	END`},
+
+	// function: random string generator
+	{"randstr", `CREATE FUNCTION randstr (length SMALLINT(3)) RETURNS varchar(100)
+	DETERMINISTIC
+	READS SQL DATA
+	BEGIN
+		SET @returnStr = '';
+		SET @allowedChars = 'ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789';
+		SET @i = 0;
+
+		WHILE (@i < length) DO
+			SET @returnStr = CONCAT(@returnStr, substring(@allowedChars, FLOOR(RAND() * LENGTH(@allowedChars) + 1), 1));
+			SET @i = @i + 1;
+		END WHILE;
+
+		RETURN @returnStr;
+	END`},
+}
@@ -0,0 +1,392 @@
+package dorm
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/rutl/refl"
+)
+
+// Issues reported by DiffSchema
+const (
+	DriftMissing  = "missing"
+	DriftExtra    = "extra"
+	DriftMismatch = "mismatch"
+)
+
+// Drift is a single difference between what a model
+// declares, and what is present in the live database
+type Drift struct {
+	Table    string `json:"table"`
+	Kind     string `json:"kind"` // table, column, index, fk, trigger, behavior, history
+	Name     string `json:"name"`
+	Issue    string `json:"issue"` // missing, extra, mismatch
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+func (d Drift) String() string {
+	out := fmt.Sprintf("%s: %s %s %s", d.Table, d.Issue, d.Kind, d.Name)
+	if d.Issue == DriftMismatch {
+		out += fmt.Sprintf(" (expected: %s, actual: %s)", d.Expected, d.Actual)
+	}
+	return out
+}
+
+// SchemaDiff is the list of differences between
+// the models and the live database
+type SchemaDiff []Drift
+
+func (s SchemaDiff) String() string {
+	lines := make([]string, len(s))
+	for i, d := range s {
+		lines[i] = d.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DiffSchema compares each model's columns (sql tag), indexes
+// (unique and index tags), foreign keys (fk tag), behaviors and
+// custom triggers with what INFORMATION_SCHEMA reports for the
+// live database. It lists every item that is missing, extra or
+// mismatched, which makes it fit to be run as a startup check or
+// in CI. An empty diff means the database matches the models
+func DiffSchema(models ...interface{}) SchemaDiff {
+	diff, err := DiffSchemaE(models...)
+	if err != nil {
+		panic(err)
+	}
+	return diff
+}
+
+// DiffSchemaE is DiffSchema, returning a *SchemaError
+// instead of panicking when the database cannot be read
+func DiffSchemaE(models ...interface{}) (diff SchemaDiff, err error) {
+
+	tbl := ""
+	defer func() {
+		if r := recover(); r != nil {
+			err = asSchemaError(r, tbl, PhaseDiff)
+		}
+	}()
+
+	dbo := db()
+	if dbo == nil {
+		return nil, &SchemaError{Phase: PhaseDiff, Err: errors.New("connection is null. Please specify the DB to compare")}
+	}
+
+	// soft cascades are triggers upon the referenced table
+	cascades := map[string][]string{}
+	for _, model := range models {
+		tbl = Table(model)
+		for _, fk := range modelForeignKeys(dbo, model) {
+			if fk.SoftCascade {
+				cascades[fk.RefTable] = append(cascades[fk.RefTable], mysqlSQL{}.softCascade(tbl, fk))
+			}
+		}
+	}
+
+	out := SchemaDiff{}
+	for _, model := range models {
+		tbl = Table(model)
+		if !dbo.Dialect().HasTable(tbl) {
+			out = append(out, Drift{Table: tbl, Kind: "table", Name: tbl, Issue: DriftMissing})
+			continue
+		}
+		out = append(out, diffColumns(dbo, model)...)
+		out = append(out, diffIndexes(dbo, model)...)
+		out = append(out, diffForeignKeys(dbo, model)...)
+		out = append(out, diffTriggers(dbo, model, cascades[tbl])...)
+		if isHistoric(model) {
+			out = append(out, diffHistory(dbo, model)...)
+		}
+	}
+	return out, nil
+}
+
+// isHistoric tells if the model keeps an audit trail
+func isHistoric(model interface{}) bool {
+	return !strings.HasPrefix(Table(model), historyPrefix) && refl.ComposedOf(model, Historic{})
+}
+
+type schemaColumn struct {
+	Name     string `gorm:"column:COLUMN_NAME"`
+	Type     string `gorm:"column:COLUMN_TYPE"`
+	Nullable string `gorm:"column:IS_NULLABLE"`
+}
+
+func liveColumns(dbo *gorm.DB, tbl string) []schemaColumn {
+	var cols []schemaColumn
+	err := dbo.Raw("SELECT COLUMN_NAME, COLUMN_TYPE, IS_NULLABLE FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", tbl).Scan(&cols).Error
+	if err != nil {
+		panic(err)
+	}
+	return cols
+}
+
+var (
+	intWidthRegex  = regexp.MustCompile(`\b(tinyint|smallint|mediumint|int|integer|bigint)\(\d+\)`)
+	typeNoiseRegex = regexp.MustCompile(`\b(auto_increment|binary|not null|null|primary key)\b`)
+)
+
+// normalizeType reduces a column type to a form that can be
+// compared across the model (gorm) and the database: integer
+// display widths and attributes that mysql reports elsewhere
+// are dropped
+func normalizeType(typ string) string {
+	typ = strings.ToLower(typ)
+	typ = strings.Replace(typ, "integer", "int", -1)
+	typ = strings.Replace(typ, "boolean", "tinyint", -1)
+	typ = intWidthRegex.ReplaceAllString(typ, "$1")
+	typ = typeNoiseRegex.ReplaceAllString(typ, "")
+	return strings.Join(strings.Fields(typ), " ")
+}
+
+func diffColumns(dbo *gorm.DB, model interface{}) []Drift {
+	tbl := Table(model)
+	out := []Drift{}
+
+	live := map[string]schemaColumn{}
+	order := []string{}
+	for _, c := range liveColumns(dbo, tbl) {
+		live[c.Name] = c
+		order = append(order, c.Name)
+	}
+
+	scope := dbo.NewScope(model)
+	expected := map[string]bool{}
+	for _, field := range scope.GetModelStruct().StructFields {
+		if !field.IsNormal {
+			continue
+		}
+		expected[field.DBName] = true
+
+		_, _, _, extra := gorm.ParseFieldStructForDialect(field, scope.Dialect())
+		typ := strings.TrimSpace(strings.TrimSuffix(scope.Dialect().DataTypeOf(field), extra))
+		_, notNull := field.TagSettingsGet("NOT NULL")
+		nullable := "YES"
+		if notNull || field.IsPrimaryKey {
+			nullable = "NO"
+		}
+
+		c, ok := live[field.DBName]
+		if !ok {
+			out = append(out, Drift{Table: tbl, Kind: "column", Name: field.DBName, Issue: DriftMissing, Expected: typ})
+			continue
+		}
+		if normalizeType(typ) != normalizeType(c.Type) {
+			out = append(out, Drift{Table: tbl, Kind: "column", Name: field.DBName, Issue: DriftMismatch, Expected: typ, Actual: c.Type})
+		}
+		if nullable != c.Nullable {
+			out = append(out, Drift{Table: tbl, Kind: "column", Name: field.DBName, Issue: DriftMismatch, Expected: "nullable=" + nullable, Actual: "nullable=" + c.Nullable})
+		}
+	}
+
+	for _, name := range order {
+		if !expected[name] {
+			out = append(out, Drift{Table: tbl, Kind: "column", Name: name, Issue: DriftExtra, Actual: live[name].Type})
+		}
+	}
+
+	return out
+}
+
+func diffIndexes(dbo *gorm.DB, model interface{}) []Drift {
+	tbl := Table(model)
+	out := []Drift{}
+
+	live, order := liveIndexes(dbo, tbl)
+	describe := indexDef.String
+	if !keepsDesc(dbo) {
+		// the server stores no direction to compare
+		describe = func(idx indexDef) string {
+			return idx.ascending().String()
+		}
+	}
+
+	// indexes that mysql maintains on its own
+	expected := map[string]bool{"PRIMARY": true}
+	for _, fk := range modelForeignKeys(dbo, model) {
+		expected[fk.Name] = true
+	}
+
+	for _, idx := range modelIndexes(model) {
+		expected[idx.Name] = true
+		l, ok := live[idx.Name]
+		if !ok {
+			out = append(out, Drift{Table: tbl, Kind: "index", Name: idx.Name, Issue: DriftMissing, Expected: describe(idx)})
+			continue
+		}
+		if describe(idx) != describe(l) {
+			out = append(out, Drift{Table: tbl, Kind: "index", Name: idx.Name, Issue: DriftMismatch, Expected: describe(idx), Actual: describe(l)})
+		}
+	}
+
+	for _, name := range order {
+		if !expected[name] {
+			out = append(out, Drift{Table: tbl, Kind: "index", Name: name, Issue: DriftExtra, Actual: describe(live[name])})
+		}
+	}
+
+	return out
+}
+
+func diffForeignKeys(dbo *gorm.DB, model interface{}) []Drift {
+	tbl := Table(model)
+	out := []Drift{}
+
+	live, order := liveForeignKeys(dbo, tbl)
+	describe := foreignKeyDef.String
+
+	expected := map[string]bool{}
+	for _, fk := range modelForeignKeys(dbo, model) {
+		expected[fk.Name] = true
+		l, ok := live[fk.Name]
+		if !ok {
+			out = append(out, Drift{Table: tbl, Kind: "fk", Name: fk.Name, Issue: DriftMissing, Expected: describe(fk)})
+			continue
+		}
+		if describe(fk) != describe(l) {
+			out = append(out, Drift{Table: tbl, Kind: "fk", Name: fk.Name, Issue: DriftMismatch, Expected: describe(fk), Actual: describe(l)})
+		}
+	}
+
+	for _, name := range order {
+		if !expected[name] {
+			out = append(out, Drift{Table: tbl, Kind: "fk", Name: name, Issue: DriftExtra, Actual: describe(live[name])})
+		}
+	}
+
+	return out
+}
+
+type schemaTrigger struct {
+	Name      string `gorm:"column:TRIGGER_NAME"`
+	Timing    string `gorm:"column:ACTION_TIMING"`
+	Event     string `gorm:"column:EVENT_MANIPULATION"`
+	Statement string `gorm:"column:ACTION_STATEMENT"`
+}
+
+var triggerHeadRegex = regexp.MustCompile(`(?is)^\s*CREATE\s+.*?TRIGGER\s+\S+\s+(BEFORE|AFTER)\s+(INSERT|UPDATE|DELETE)\s+ON\s+\S+\s+FOR\s+EACH\s+ROW\s+(.*)$`)
+
+// normalizeBody makes trigger bodies comparable,
+// ignoring whitespace and a trailing semicolon
+func normalizeBody(body string) string {
+	body = strings.Join(strings.Fields(body), " ")
+	return strings.TrimSpace(strings.TrimSuffix(body, ";"))
+}
+
+// diffTriggers compares the triggers of the table with those
+// of the model, along with the incoming ones (the soft cascades
+// of the models that reference it)
+func diffTriggers(dbo *gorm.DB, model interface{}, incoming []string) []Drift {
+	tbl := Table(model)
+	out := []Drift{}
+
+	var rows []schemaTrigger
+	err := dbo.Raw("SELECT TRIGGER_NAME, ACTION_TIMING, EVENT_MANIPULATION, ACTION_STATEMENT FROM INFORMATION_SCHEMA.TRIGGERS WHERE TRIGGER_SCHEMA = DATABASE() AND EVENT_OBJECT_TABLE = ?", tbl).Scan(&rows).Error
+	if err != nil {
+		panic(err)
+	}
+	live := map[string]schemaTrigger{}
+	for _, r := range rows {
+		live[r.Name] = r
+	}
+
+	// triggers of behaviors, audit log and the model itself
+	stmts := behaviorStatements(mysqlSQL{}, dbo, model)
+	if isHistoric(model) {
+		cols := []string{}
+		for _, c := range liveColumns(dbo, tbl) {
+			cols = append(cols, c.Name)
+		}
+		stmts = append(stmts, mysqlAuditTriggers(tbl, cols)...)
+	}
+	if m, ok := model.(triggered); ok {
+		stmts = append(stmts, m.Triggers()...)
+	}
+	stmts = append(stmts, incoming...)
+
+	expected := map[string]bool{}
+	for _, stmt := range stmts {
+		name := triggerName(stmt)
+		if name == "" {
+			// a dynamic behavior only returns statements
+			// when the table does not match it
+			out = append(out, Drift{Table: tbl, Kind: "behavior", Name: strings.Join(strings.Fields(stmt), " "), Issue: DriftMismatch, Expected: "applied", Actual: "not applied"})
+			continue
+		}
+		expected[name] = true
+
+		l, ok := live[name]
+		if !ok {
+			out = append(out, Drift{Table: tbl, Kind: "trigger", Name: name, Issue: DriftMissing})
+			continue
+		}
+		m := triggerHeadRegex.FindStringSubmatch(stmt)
+		if m == nil {
+			continue
+		}
+		if !strings.EqualFold(m[1], l.Timing) || !strings.EqualFold(m[2], l.Event) {
+			out = append(out, Drift{Table: tbl, Kind: "trigger", Name: name, Issue: DriftMismatch,
+				Expected: strings.ToUpper(m[1] + " " + m[2]), Actual: l.Timing + " " + l.Event})
+		} else if normalizeBody(m[3]) != normalizeBody(l.Statement) {
+			out = append(out, Drift{Table: tbl, Kind: "trigger", Name: name, Issue: DriftMismatch, Expected: "body as declared", Actual: "body differs"})
+		}
+	}
+
+	names := []string{}
+	for name := range live {
+		if !expected[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out = append(out, Drift{Table: tbl, Kind: "trigger", Name: name, Issue: DriftExtra})
+	}
+
+	return out
+}
+
+// diffHistory compares the columns of the history
+// table with those of its base table
+func diffHistory(dbo *gorm.DB, model interface{}) []Drift {
+	tbl := Table(model)
+	hist := historyPrefix + tbl
+	out := []Drift{}
+
+	if !dbo.Dialect().HasTable(hist) {
+		return append(out, Drift{Table: tbl, Kind: "history", Name: hist, Issue: DriftMissing})
+	}
+
+	base := liveColumns(dbo, tbl)
+	live := map[string]schemaColumn{}
+	for _, c := range liveColumns(dbo, hist) {
+		live[c.Name] = c
+	}
+
+	expected := map[string]bool{"row_id": true, "action": true, "actioned_at": true}
+	for _, c := range base {
+		expected[c.Name] = true
+		h, ok := live[c.Name]
+		if !ok {
+			out = append(out, Drift{Table: tbl, Kind: "history", Name: hist + "." + c.Name, Issue: DriftMissing, Expected: c.Type})
+			continue
+		}
+		if normalizeType(h.Type) != normalizeType(c.Type) {
+			out = append(out, Drift{Table: tbl, Kind: "history", Name: hist + "." + c.Name, Issue: DriftMismatch, Expected: c.Type, Actual: h.Type})
+		}
+	}
+	for _, c := range liveColumns(dbo, hist) {
+		if !expected[c.Name] {
+			out = append(out, Drift{Table: tbl, Kind: "history", Name: hist + "." + c.Name, Issue: DriftExtra, Actual: c.Type})
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,30 @@
+package dorm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeType(t *testing.T) {
+	assert.Equal(t, "varchar(10)", normalizeType("varchar(10) binary"))
+	assert.Equal(t, "int unsigned", normalizeType("int(10) unsigned"))
+	assert.Equal(t, "int unsigned", normalizeType("int unsigned AUTO_INCREMENT"))
+	assert.Equal(t, "tinyint unsigned", normalizeType("tinyint(1) unsigned"))
+	assert.Equal(t, "datetime(4)", normalizeType("DATETIME(4) NULL"))
+	assert.Equal(t, "decimal(10,2)", normalizeType("DECIMAL(10,2)"))
+}
+
+func TestTriggerHead(t *testing.T) {
+	stmt := `CREATE TRIGGER product_softdelete_bfr_delete BEFORE DELETE ON product FOR EACH ROW
+		IF TRUE THEN 
+			SIGNAL SQLSTATE '45000';
+		END IF;`
+
+	m := triggerHeadRegex.FindStringSubmatch(stmt)
+	assert.NotNil(t, m)
+	assert.Equal(t, "BEFORE", m[1])
+	assert.Equal(t, "DELETE", m[2])
+	assert.Equal(t, "IF TRUE THEN SIGNAL SQLSTATE '45000'; END IF", normalizeBody(m[3]))
+	assert.Equal(t, normalizeBody(m[3]), normalizeBody("IF TRUE THEN\n SIGNAL SQLSTATE '45000';\nEND IF"))
+}
@@ -3,6 +3,8 @@ package dorm
 import (
 	"fmt"
 	"strings"
+
+	"github.com/jinzhu/gorm"
 )
 
 const historyPrefix = "zoom_"
@@ -79,8 +81,9 @@ func initStaticBehaviors() {
 	// SoftDelete
 	behave[SoftDelete{}] = []string{
 		// do not allow delete action
+		// unless purging (see PurgeDeleted)
 		`CREATE TRIGGER <<Table>>_softdelete_bfr_delete BEFORE DELETE ON <<Table>> FOR EACH ROW
-		IF TRUE THEN 
+		IF COALESCE(@dorm_purge, 0) = 0 THEN
 			SIGNAL SQLSTATE '45000'
 			SET MESSAGE_TEXT = 'Cannot delete records from table. Instead set deleted=1';
 		END IF;`,
@@ -99,8 +102,9 @@ func initStaticBehaviors() {
 	// SoftDelete4
 	behave[SoftDelete4{}] = []string{
 		// do not allow delete action
+		// unless purging (see PurgeDeleted)
 		`CREATE TRIGGER <<Table>>_softdelete_bfr_delete BEFORE DELETE ON <<Table>> FOR EACH ROW
-			IF TRUE THEN 
+			IF COALESCE(@dorm_purge, 0) = 0 THEN
 				SIGNAL SQLSTATE '45000'
 				SET MESSAGE_TEXT = 'Cannot delete records from table. Instead set deleted=1';
 			END IF;`,
@@ -116,6 +120,24 @@ func initStaticBehaviors() {
 			END`,
 	}
 
+	// Tenanted
+	behave[Tenanted{}] = []string{
+		`CREATE TRIGGER <<Table>>_tenanted_bfr_update BEFORE UPDATE ON <<Table>> FOR EACH ROW
+		IF NEW.tenant_id <> OLD.tenant_id THEN
+			SIGNAL SQLSTATE '45000'
+			SET MESSAGE_TEXT = 'tenant_id cannot be updated';
+		END IF;`,
+	}
+
+	// Versioned
+	behave[Versioned{}] = []string{
+		// unless rotating keys (see RotateKeys)
+		`CREATE TRIGGER <<Table>>_versioned_bfr_update BEFORE UPDATE ON <<Table>> FOR EACH ROW
+		IF COALESCE(@dorm_rotate, 0) = 0 THEN
+			SET NEW.version = OLD.version + 1;
+		END IF;`,
+	}
+
 	behave[Stateful{}] = []string{
 		`CREATE TRIGGER <<Table>>_stateful_bfr_insert BEFORE INSERT ON <<Table>> FOR EACH ROW
         BEGIN
@@ -742,106 +764,57 @@ func initStaticBehaviors() {
 func initDynamicBehaviors() {
 
 	// Timed
-	behaveModel[Timed{}] = func(model interface{}) []string {
-		type Field struct {
-			Name    string  `gorm:"column:Field"`
-			Type    string  `gorm:"column:Type"`
-			Null    string  `gorm:"column:Null"`
-			Key     string  `gorm:"column:Key"`
-			Default *string `gorm:"column:Default"`
-			Extra   string  `gorm:"column:Extra"`
-		}
-		var f Field
-		err := db().Raw("show columns from " + Table(model) + " where Field = 'updated_at'").Find(&f).Error
-		if err != nil {
-			panic(err)
-		}
-		if !strings.Contains(strings.ToLower(f.Extra), "on update current_timestamp") {
-			return []string{
-				"ALTER TABLE <<Table>> MODIFY COLUMN updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP",
-			}
-		}
-		return []string{}
+	behaveModel[Timed{}] = func(dbo *gorm.DB, model interface{}) []string {
+		return onUpdateTimestamp(dbo, model, "ALTER TABLE <<Table>> MODIFY COLUMN updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP")
 	}
 
 	// TimedLite
-	behaveModel[TimedLite{}] = func(model interface{}) []string {
-		type Field struct {
-			Name    string  `gorm:"column:Field"`
-			Type    string  `gorm:"column:Type"`
-			Null    string  `gorm:"column:Null"`
-			Key     string  `gorm:"column:Key"`
-			Default *string `gorm:"column:Default"`
-			Extra   string  `gorm:"column:Extra"`
-		}
-		var f Field
-		err := db().Raw("show columns from " + Table(model) + " where Field = 'updated_at'").Find(&f).Error
-		if err != nil {
-			panic(err)
-		}
-		if !strings.Contains(strings.ToLower(f.Extra), "on update current_timestamp") {
-			return []string{
-				"ALTER TABLE <<Table>> MODIFY COLUMN updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP",
-			}
-		}
-		return []string{}
+	behaveModel[TimedLite{}] = func(dbo *gorm.DB, model interface{}) []string {
+		return onUpdateTimestamp(dbo, model, "ALTER TABLE <<Table>> MODIFY COLUMN updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP")
 	}
 
 	// Timed4
-	behaveModel[Timed4{}] = func(model interface{}) []string {
-		type Field struct {
-			Name    string  `gorm:"column:Field"`
-			Type    string  `gorm:"column:Type"`
-			Null    string  `gorm:"column:Null"`
-			Key     string  `gorm:"column:Key"`
-			Default *string `gorm:"column:Default"`
-			Extra   string  `gorm:"column:Extra"`
-		}
-		var f Field
-		err := db().Raw("show columns from " + Table(model) + " where Field = 'updated_at'").Find(&f).Error
-		if err != nil {
-			panic(err)
-		}
-		if !strings.Contains(strings.ToLower(f.Extra), "on update current_timestamp") {
-			return []string{
-				"ALTER TABLE <<Table>> MODIFY COLUMN updated_at DATETIME(4) NOT NULL DEFAULT CURRENT_TIMESTAMP(4) ON UPDATE CURRENT_TIMESTAMP(4)",
-			}
-		}
-		return []string{}
+	behaveModel[Timed4{}] = func(dbo *gorm.DB, model interface{}) []string {
+		return onUpdateTimestamp(dbo, model, "ALTER TABLE <<Table>> MODIFY COLUMN updated_at DATETIME(4) NOT NULL DEFAULT CURRENT_TIMESTAMP(4) ON UPDATE CURRENT_TIMESTAMP(4)")
 	}
 
 	// Timed4Lite
-	behaveModel[Timed4Lite{}] = func(model interface{}) []string {
-		type Field struct {
-			Name    string  `gorm:"column:Field"`
-			Type    string  `gorm:"column:Type"`
-			Null    string  `gorm:"column:Null"`
-			Key     string  `gorm:"column:Key"`
-			Default *string `gorm:"column:Default"`
-			Extra   string  `gorm:"column:Extra"`
-		}
-		var f Field
-		err := db().Raw("show columns from " + Table(model) + " where Field = 'updated_at'").Find(&f).Error
-		if err != nil {
-			panic(err)
-		}
-		if !strings.Contains(strings.ToLower(f.Extra), "on update current_timestamp") {
-			return []string{
-				"ALTER TABLE <<Table>> MODIFY COLUMN updated_at DATETIME(4) NOT NULL DEFAULT CURRENT_TIMESTAMP(4) ON UPDATE CURRENT_TIMESTAMP(4)",
-			}
-		}
-		return []string{}
+	behaveModel[Timed4Lite{}] = func(dbo *gorm.DB, model interface{}) []string {
+		return onUpdateTimestamp(dbo, model, "ALTER TABLE <<Table>> MODIFY COLUMN updated_at DATETIME(4) NOT NULL DEFAULT CURRENT_TIMESTAMP(4) ON UPDATE CURRENT_TIMESTAMP(4)")
 	}
 
 	// MyISAM
-	behaveModel[MyISAM{}] = func(model interface{}) []string {
+	behaveModel[MyISAM{}] = func(dbo *gorm.DB, model interface{}) []string {
+		var engine string
+		dbo.Raw("SELECT ENGINE FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", Table(model)).Row().Scan(&engine)
+		if strings.EqualFold(engine, "MyISAM") {
+			return []string{}
+		}
 		return []string{
 			"ALTER TABLE <<Table>> ENGINE = MyISAM",
 		}
 	}
 
+	// Ordered, whose concurrent appends may tie (see Ordered)
+	behaveModel[Ordered{}] = func(dbo *gorm.DB, model interface{}) []string {
+		where := ""
+		if scope := (Ordered{}).ScopeColumn(model); scope != "" {
+			where = fmt.Sprintf(" WHERE `%s` <=> NEW.`%s`", scope, scope)
+		}
+		cols := func(tbl string) ([]showColumn, error) {
+			return showColumns(dbo, tbl, "Field = 'sequence'")
+		}
+		return append(orderedDefault(dbo, model, cols, "ALTER TABLE <<Table>> ALTER COLUMN sequence SET DEFAULT 0"),
+			fmt.Sprintf(`CREATE TRIGGER <<Table>>_ordered_bfr_insert BEFORE INSERT ON <<Table>> FOR EACH ROW
+			BEGIN
+				IF NEW.sequence IS NULL OR NEW.sequence = 0 THEN
+					SET NEW.sequence = (SELECT COALESCE(MAX(sequence), 0) + 1 FROM <<Table>>%s);
+				END IF;
+			END`, where))
+	}
+
 	// SEO
-	behaveModel[SeoField{}] = func(model interface{}) []string {
+	behaveModel[SeoField{}] = func(dbo *gorm.DB, model interface{}) []string {
 		s := SeoField{}
 
 		urlRefModel, colToQuery, colToFetch := s.GetURLRef(model)
@@ -923,3 +896,21 @@ func initDynamicBehaviors() {
 	}
 
 }
+
+// onUpdateTimestamp returns the given statement (that sets
+// "on update current_timestamp" upon updated_at) unless the
+// column already has it. A table that does not exist yet
+// always needs it
+func onUpdateTimestamp(dbo *gorm.DB, model interface{}, ddl string) []string {
+	tbl := Table(model)
+	if dbo.HasTable(tbl) {
+		flds, err := showColumns(dbo, tbl, "Field = 'updated_at'")
+		if err != nil {
+			panic(err)
+		}
+		if len(flds) > 0 && strings.Contains(strings.ToLower(flds[0].Extra), "on update current_timestamp") {
+			return []string{}
+		}
+	}
+	return []string{ddl}
+}
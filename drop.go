@@ -0,0 +1,152 @@
+package dorm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rightjoin/rutl/refl"
+)
+
+// DropSchema removes the given models from the database: their
+// triggers (custom, behavior and audit), history table, foreign
+// keys (with their soft cascades) and, lastly, their tables.
+// Foreign keys of all the models are dropped ahead of any table,
+// so the models may be given in any order. Tables referenced by
+// foreign keys of other tables (that are not dropped along) are
+// not dropped, and nothing is. Archives of history (see
+// PruneHistory) are kept
+func DropSchema(models ...interface{}) {
+	if err := DropSchemaE(models...); err != nil {
+		panic(err)
+	}
+}
+
+// DropSchemaE is DropSchema, returning a *SchemaError
+// instead of panicking. It is done holding LockSchema
+func DropSchemaE(models ...interface{}) (err error) {
+	b := newSchemaBuilder(false)
+	if b.dbo == nil {
+		return &SchemaError{Phase: PhaseLock, Err: errors.New("connection is null. Please specify the DB to drop from")}
+	}
+
+	err = WithDBLock(b.dbo, LockSchema, func() (err error) {
+		defer b.catch(&err)
+		b.drop(models...)
+		return nil
+	})
+	if _, ok := err.(*SchemaError); err != nil && !ok {
+		err = &SchemaError{Phase: PhaseLock, Statement: "GET_LOCK " + LockSchema, Err: err}
+	}
+	return err
+}
+
+// PlanDropSchema works out every statement that DropSchema
+// would run for the given models, without running any of them
+func PlanDropSchema(models ...interface{}) Plan {
+	plan, err := PlanDropSchemaE(models...)
+	if err != nil {
+		panic(err)
+	}
+	return plan
+}
+
+// PlanDropSchemaE is PlanDropSchema, returning a *SchemaError
+// instead of panicking when the plan cannot be worked out
+func PlanDropSchemaE(models ...interface{}) (plan Plan, err error) {
+	b := newSchemaBuilder(true)
+	defer b.catch(&err)
+	b.drop(models...)
+	return b.plan, nil
+}
+
+// drop runs every phase of the teardown for the given
+// models, in the reverse order of a build
+func (b *schemaBuilder) drop(models ...interface{}) {
+
+	// tables that are referenced from tables left in
+	// place would block the drop, so none is dropped
+	dropped := map[string]bool{}
+	for _, model := range models {
+		dropped[Table(model)] = true
+	}
+	for _, model := range models {
+		b.at(model, PhaseDropTable)
+		tbl := Table(model)
+		if !b.hasTable(tbl) {
+			continue
+		}
+		for _, from := range b.sql.referencedBy(b.dbo, tbl) {
+			if !dropped[from] {
+				panic(fmt.Errorf("referenced by a foreign key of %s, which is not dropped along", from))
+			}
+		}
+	}
+
+	// custom triggers, then behaviors
+	for _, model := range models {
+		b.at(model, PhaseTrigger)
+		if m, ok := model.(triggered); ok {
+			b.dropTriggers(Table(model), PhaseTrigger, m.Triggers())
+		}
+	}
+	for _, model := range models {
+		b.at(model, PhaseBehavior)
+		b.dropTriggers(Table(model), PhaseBehavior, behaviorStatements(b.sql, b.dbo, model))
+	}
+
+	// audit triggers and history table
+	for _, model := range models {
+		if refl.ComposedOf(model, Historic{}) {
+			b.at(model, PhaseHistory)
+			tbl := Table(model)
+			b.dropTriggers(tbl, PhaseHistory, b.sql.auditTriggers(tbl, nil))
+			if b.hasTable(historyPrefix + tbl) {
+				b.exec(tbl, PhaseHistory, "DROP TABLE "+b.dbo.Dialect().Quote(historyPrefix+tbl))
+			}
+		}
+	}
+
+	// foreign keys of all models, so that
+	// tables can then be dropped in any order
+	for _, model := range models {
+		b.at(model, PhaseForeignKey)
+		tbl := Table(model)
+		if !b.hasTable(tbl) {
+			continue
+		}
+		for _, fk := range modelForeignKeys(b.dbo, model) {
+			if fk.SoftCascade {
+				b.dropTriggers(fk.RefTable, PhaseForeignKey, []string{b.sql.softCascade(tbl, fk)})
+			}
+		}
+		_, order := b.sql.liveForeignKeys(b.dbo, tbl)
+		for _, name := range order {
+			b.exec(tbl, PhaseForeignKey, b.sql.dropForeignKey(tbl, name))
+		}
+	}
+
+	// tables, along with the checksums of
+	// the objects generated for them
+	objects := Table(SchemaObject{})
+	for _, model := range models {
+		b.at(model, PhaseDropTable)
+		tbl := Table(model)
+		if b.hasTable(tbl) {
+			b.exec(tbl, PhaseDropTable, "DROP TABLE "+b.dbo.Dialect().Quote(tbl))
+		}
+		if b.hasTable(objects) {
+			b.exec(tbl, PhaseDropTable, "DELETE FROM "+objects+" WHERE entity = "+sqlLiteral(tbl))
+		}
+	}
+}
+
+// dropTriggers drops the triggers (that exist) among those
+// created by the given statements
+func (b *schemaBuilder) dropTriggers(table string, phase string, stmts []string) {
+	for _, stmt := range stmts {
+		name := triggerName(stmt)
+		if name != "" && b.sql.hasTrigger(b.dbo, name) {
+			b.exec(table, phase, b.sql.dropTrigger(name, table))
+		}
+	}
+}
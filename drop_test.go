@@ -0,0 +1,69 @@
+package dorm
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type crate struct {
+	PKey
+	Label string `sql:"TYPE:varchar(64)" json:"label"`
+	SoftDelete
+	Historic
+}
+
+func (crate) Triggers() []string {
+	return []string{"CREATE TRIGGER crate_label BEFORE INSERT ON crate FOR EACH ROW SET NEW.label = TRIM(NEW.label)"}
+}
+
+type box struct {
+	PKey
+	CrateID uint `json:"crate_id" fk:"crate(id)"`
+}
+
+func TestPlanDropSchema(t *testing.T) {
+	dbo, f := newFakeDB(t)
+	f.on("SHOW TABLES", fakeReply{cols: []string{"table"}, rows: [][]driver.Value{{"t"}}})
+	f.on("INFORMATION_SCHEMA.TRIGGERS", fakeReply{cols: []string{"count"}, rows: [][]driver.Value{{int64(1)}}})
+	f.on("REFERENCED_TABLE_NAME = ?", fakeReply{cols: []string{"TABLE_NAME"}, rows: [][]driver.Value{{"box"}}})
+	f.on("k.TABLE_NAME = ?", fakeReply{
+		cols: []string{"CONSTRAINT_NAME", "COLUMN_NAME", "REFERENCED_TABLE_NAME", "REFERENCED_COLUMN_NAME", "DELETE_RULE", "UPDATE_RULE"},
+		rows: [][]driver.Value{{"box_crate_id_crate_id_foreign", "crate_id", "crate", "id", "RESTRICT", "RESTRICT"}},
+	})
+	OverrideDB = dbo
+	defer func() { OverrideDB = nil }()
+
+	// the child is dropped along, in any order
+	plan, err := PlanDropSchemaE(&crate{}, &box{})
+	assert.Nil(t, err)
+
+	order := []string{PhaseTrigger, PhaseBehavior, PhaseHistory, PhaseForeignKey, PhaseDropTable}
+	rank := 0
+	for _, step := range plan {
+		r := 0
+		for r < len(order) && order[r] != step.Phase {
+			r++
+		}
+		if assert.True(t, r < len(order), step.Phase) {
+			assert.True(t, r >= rank, "%s after %s", step.Phase, order[rank])
+			rank = r
+		}
+	}
+	assert.Equal(t, PhaseDropTable, plan[len(plan)-1].Phase)
+
+	sqls := plan.String()
+	assert.Contains(t, sqls, "DROP TRIGGER")
+	assert.Contains(t, sqls, "DROP TABLE `zoom_crate`")
+	assert.Contains(t, sqls, "DROP FOREIGN KEY `box_crate_id_crate_id_foreign`")
+	assert.True(t, strings.Index(sqls, "DROP FOREIGN KEY") < strings.Index(sqls, "DROP TABLE `crate`"))
+
+	// but a table referenced from one left in place is not dropped
+	_, err = PlanDropSchemaE(&crate{})
+	se, ok := err.(*SchemaError)
+	assert.True(t, ok)
+	assert.Equal(t, "crate", se.Table)
+	assert.Contains(t, se.Error(), "foreign key of box")
+}
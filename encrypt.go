@@ -0,0 +1,551 @@
+package dorm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/fig"
+	"github.com/rightjoin/rutl/conv"
+	"github.com/rightjoin/rutl/refl"
+	"github.com/rs/zerolog/log"
+)
+
+// Keyring holds the keys that encrypt the data keys of columns
+// tagged encrypt:"true". Keys are 32 bytes (AES-256), and are
+// known by a version; values are encrypted with the current key,
+// and decrypted with the key they were encrypted with
+type Keyring interface {
+	Current() (version string, key []byte, err error)
+	Key(version string) ([]byte, error)
+}
+
+// Keys is the keyring of encrypted columns. It must be set
+// before models with encrypted columns are written or read
+var Keys Keyring
+
+// ErrNoKeyring is returned when an encrypted column
+// is written or read, but Keys is not set
+var ErrNoKeyring = errors.New("no keyring for encrypted column")
+
+// encrypted values are of the form
+// enc:v1:<key version>:<wrapped data key>:<nonce and ciphertext>
+const encPrefix = "enc:v1:"
+
+var keyVersionRegex = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// StaticKeyring is a Keyring of the given keys, along with
+// the key of blind indexes (see BlindKeyring)
+type StaticKeyring struct {
+	Version string
+	Keys    map[string][]byte
+	Blind   []byte
+}
+
+func (k StaticKeyring) Current() (string, []byte, error) {
+	key, err := k.Key(k.Version)
+	return k.Version, key, err
+}
+
+func (k StaticKeyring) Key(version string) ([]byte, error) {
+	key, ok := k.Keys[version]
+	if !ok {
+		return nil, fmt.Errorf("no key of version %s", version)
+	}
+	return key, nil
+}
+
+// ConfigKeyring reads the keys (base64 encoded) from config:
+// database:
+//		encrypt:
+//			current: version of the key to encrypt with
+//			keys:
+//				<version>: key
+//			blind: key of blind indexes
+func ConfigKeyring() StaticKeyring {
+	k := StaticKeyring{
+		Version: fig.String("database.encrypt.current"),
+		Keys:    map[string][]byte{},
+	}
+	if blind := fig.StringOr("", "database.encrypt.blind"); blind != "" {
+		key, err := base64.StdEncoding.DecodeString(blind)
+		if err != nil {
+			panic(fmt.Sprintf("database.encrypt.blind is not base64: %s", err))
+		}
+		k.Blind = key
+	}
+	for version, val := range fig.Map("database.encrypt.keys") {
+		key, err := base64.StdEncoding.DecodeString(fmt.Sprint(val))
+		if err != nil {
+			panic(fmt.Sprintf("database.encrypt.keys.%s is not base64: %s", version, err))
+		}
+		k.Keys[version] = key
+	}
+	return k
+}
+
+// encryptValue encrypts the value with a new data key (AES-GCM),
+// which is itself encrypted (wrapped) with the current key
+func encryptValue(ring Keyring, plain string) (string, error) {
+	if ring == nil {
+		return "", ErrNoKeyring
+	}
+	version, kek, err := ring.Current()
+	if err != nil {
+		return "", err
+	}
+	if !keyVersionRegex.MatchString(version) {
+		return "", fmt.Errorf("key version must be alphanumeric: %s", version)
+	}
+
+	dek := make([]byte, 32)
+	if _, err = rand.Read(dek); err != nil {
+		return "", err
+	}
+	wrapped, err := seal(kek, dek)
+	if err != nil {
+		return "", err
+	}
+	data, err := seal(dek, []byte(plain))
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawStdEncoding
+	return encPrefix + version + ":" + enc.EncodeToString(wrapped) + ":" + enc.EncodeToString(data), nil
+}
+
+// decryptValue decrypts a value from encryptValue. Values
+// that are not encrypted are returned as they are
+func decryptValue(ring Keyring, val string) (string, error) {
+	if !strings.HasPrefix(val, encPrefix) {
+		return val, nil
+	}
+	if ring == nil {
+		return "", ErrNoKeyring
+	}
+
+	parts := strings.Split(strings.TrimPrefix(val, encPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+	kek, err := ring.Key(parts[0])
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawStdEncoding
+	wrapped, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	data, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	dek, err := open(kek, wrapped)
+	if err != nil {
+		return "", err
+	}
+	plain, err := open(dek, data)
+	return string(plain), err
+}
+
+// keyVersionOf returns the version of the key that
+// the value was encrypted with, if it is encrypted
+func keyVersionOf(val string) (string, bool) {
+	if !strings.HasPrefix(val, encPrefix) {
+		return "", false
+	}
+	rest := strings.TrimPrefix(val, encPrefix)
+	return rest[:strings.Index(rest+":", ":")], true
+}
+
+func seal(key []byte, plain []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func open(key []byte, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("malformed encrypted value")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedColumns returns the columns of the model
+// tagged encrypt:"true"
+func encryptedColumns(model interface{}) []string {
+	out := []string{}
+	for _, fld := range refl.NestedFields(model) {
+		if fld.Tag.Get("encrypt") == "true" {
+			out = append(out, conv.CaseSnake(fld.Name))
+		}
+	}
+	return out
+}
+
+// modelCrypt is what the encrypt and blind_index
+// tags of a model type declare
+type modelCrypt struct {
+	columns []string
+	blinds  []blindIndex
+	err     error
+}
+
+var cryptCache = map[reflect.Type]modelCrypt{}
+var cryptMutex sync.Mutex
+
+// cryptOf returns the encrypted columns and blind indexes of
+// the model, read once per type rather than on every write
+func cryptOf(model interface{}) modelCrypt {
+	t := reflect.TypeOf(model)
+	cryptMutex.Lock()
+	defer cryptMutex.Unlock()
+	c, ok := cryptCache[t]
+	if !ok {
+		c.columns = encryptedColumns(model)
+		c.blinds, c.err = blindIndexes(model)
+		cryptCache[t] = c
+	}
+	return c
+}
+
+// encryptData returns the data with the values of the
+// encrypted columns of the model encrypted, and their blind
+// indexes (if any) set. The given data (which may be the
+// caller's) is left as it is
+func encryptData(model interface{}, data map[string]string) (map[string]string, error) {
+	c := cryptOf(model)
+	if c.err != nil {
+		return nil, c.err
+	}
+	cols, blinds := c.columns, c.blinds
+	if len(cols) == 0 && len(blinds) == 0 && EncryptColumn == nil {
+		return data, nil
+	}
+
+	out := make(map[string]string, len(data))
+	for k, v := range data {
+		out[k] = v
+	}
+	if EncryptColumn != nil {
+		legacyEncrypt(model, out, cols, blinds)
+	}
+	if err := blindData(model, blinds, out); err != nil {
+		return nil, err
+	}
+	for _, col := range cols {
+		val, ok := out[col]
+		if !ok || val == NullString || val == "" {
+			continue
+		}
+		enc, err := encryptValue(Keys, val)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt %s.%s: %w", Table(model), col, err)
+		}
+		out[col] = enc
+	}
+	return out, nil
+}
+
+// legacyEncrypt encrypts the values of the data with the
+// EncryptColumn hook, in place, but for those of the encrypted
+// columns and of the columns that dorm sets
+func legacyEncrypt(model interface{}, data map[string]string, cols []string, blinds []blindIndex) {
+	skip := map[string]bool{"version": true, "tenant_id": true}
+	for _, col := range cols {
+		skip[col] = true
+	}
+	for _, b := range blinds {
+		skip[b.Companion] = true
+	}
+
+	tbl := Table(model)
+	for key, val := range data {
+		if !skip[key] && val != NullString {
+			data[key] = EncryptColumn(tbl, key, val)
+		}
+	}
+}
+
+// decryptData decrypts the values of the encrypted
+// columns of the model within the data, in place
+func decryptData(model interface{}, data map[string]string) error {
+	for _, col := range cryptOf(model).columns {
+		val, ok := data[col]
+		if !ok {
+			continue
+		}
+		plain, err := decryptValue(Keys, val)
+		if err != nil {
+			return fmt.Errorf("decrypt %s.%s: %w", Table(model), col, err)
+		}
+		data[col] = plain
+	}
+	return nil
+}
+
+// decryptModel decrypts the encrypted fields
+// (string or *string) of the model, in place
+func decryptModel(addr interface{}) error {
+	v := reflect.ValueOf(addr)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct || len(cryptOf(v.Interface()).columns) == 0 {
+		return nil
+	}
+
+	for _, fld := range refl.NestedFields(v.Interface()) {
+		if fld.Tag.Get("encrypt") != "true" {
+			continue
+		}
+		f := v.FieldByName(fld.Name)
+		if f.Kind() == reflect.Ptr {
+			if f.IsNil() {
+				continue
+			}
+			f = f.Elem()
+		}
+		if f.Kind() != reflect.String || !f.CanSet() {
+			continue
+		}
+		plain, err := decryptValue(Keys, f.String())
+		if err != nil {
+			return fmt.Errorf("decrypt %s.%s: %w", Table(addr), conv.CaseSnake(fld.Name), err)
+		}
+		f.SetString(plain)
+	}
+	return nil
+}
+
+// RotateKeys encrypts the encrypted columns of the model's rows
+// with the current key, wherever they were encrypted with another
+// key (or were not encrypted, as when a column has just been
+// tagged), and returns the count of rows rotated. The versions
+// kept in the history table (of Historic models) are rotated
+// along. The rows are rewritten without firing the triggers of
+// history, version and timestamps, and so without a new version
+// of each. Rows are rotated in batches of database.encrypt.batch
+// (defaults to 500) by id, which must be an integer, across all
+// tenants. Servers that rotate at the same time take turns
+func RotateKeys(dbo *gorm.DB, model interface{}) (int, error) {
+	cols := cryptOf(model).columns
+	if len(cols) == 0 {
+		return 0, nil
+	}
+	if Keys == nil {
+		return 0, ErrNoKeyring
+	}
+	version, _, err := Keys.Current()
+	if err != nil {
+		return 0, err
+	}
+	if !keyVersionRegex.MatchString(version) {
+		return 0, fmt.Errorf("key version must be alphanumeric: %s", version)
+	}
+
+	tbl := Table(model)
+	scope := dbo.NewScope(model)
+	if f, ok := scope.FieldByName("id"); !ok || !isIntegerKind(f.Field.Kind()) {
+		return 0, fmt.Errorf("rotate keys of %s: id must be an integer", tbl)
+	}
+
+	r := rotation{
+		dbo:     dbo,
+		cols:    cols,
+		version: version,
+		batch:   fig.IntOr(500, "database.encrypt.batch"),
+	}
+	// mysql stamps updated_at unless it is set
+	if _, ok := scope.FieldByName("updated_at"); ok {
+		r.keep = "updated_at"
+	}
+
+	count := 0
+	err = WithDBLock(dbo, "dorm:rotate:"+tbl, func() error {
+		count, err = r.rotate(tbl, "id")
+		if err == nil && isHistoric(model) {
+			_, err = r.rotate(historyPrefix+tbl, "row_id")
+		}
+		return err
+	})
+	return count, err
+}
+
+func isIntegerKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// rotation re-encrypts the encrypted columns of tables
+type rotation struct {
+	dbo     *gorm.DB
+	cols    []string
+	version string
+	batch   int
+
+	// column set to itself, so that it is kept as it was
+	keep string
+}
+
+// rotate re-encrypts the rows of the table (paged by the
+// integer key column) and returns the count of rows rotated
+func (r rotation) rotate(tbl string, key string) (int, error) {
+	quote := r.dbo.Dialect().Quote
+	stale := make([]string, len(r.cols))
+	list := make([]string, len(r.cols))
+	for i, c := range r.cols {
+		list[i] = quote(c)
+		stale[i] = fmt.Sprintf("(%s <> '' AND %s NOT LIKE '%s%s:%%')", list[i], list[i], encPrefix, r.version)
+	}
+	query := "SELECT " + quote(key) + ", " + strings.Join(list, ", ") + " FROM " + quote(tbl) +
+		" WHERE " + quote(key) + " > ? AND (" + strings.Join(stale, " OR ") + ") ORDER BY " + quote(key) + " LIMIT ?"
+
+	count := 0
+	var last uint64
+	for {
+		rows, err := r.dbo.Raw(query, last, r.batch).Rows()
+		if err != nil {
+			return count, err
+		}
+
+		found := []rotatedRow{}
+		for rows.Next() {
+			row := rotatedRow{vals: make([]*string, len(r.cols))}
+			dest := []interface{}{&row.id}
+			for i := range row.vals {
+				dest = append(dest, &row.vals[i])
+			}
+			if err = rows.Scan(dest...); err != nil {
+				rows.Close()
+				return count, err
+			}
+			found = append(found, row)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return count, err
+		}
+
+		n, err := r.write(tbl, key, found)
+		count += n
+		if err != nil {
+			return count, err
+		}
+
+		if len(found) < r.batch {
+			log.Info().
+				Str("table", tbl).
+				Str("key", r.version).
+				Int("rows", count).
+				Msg("encrypt: keys rotated")
+			return count, nil
+		}
+		last = found[len(found)-1].id
+	}
+}
+
+type rotatedRow struct {
+	id   uint64
+	vals []*string
+}
+
+// write updates the rows of a batch in a transaction, within
+// which the triggers of history, version and timestamps stand
+// aside (see sqlDialect.rotate)
+func (r rotation) write(tbl string, key string, found []rotatedRow) (count int, err error) {
+	quote := r.dbo.Dialect().Quote
+	sd := dialectOf(r.dbo)
+
+	txn := r.dbo.Begin()
+	if txn.Error != nil {
+		return 0, txn.Error
+	}
+	if err = txn.Exec(sd.rotate(true)).Error; err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+	defer func() {
+		// the session variable outlives the transaction (mysql)
+		if e := txn.Exec(sd.rotate(false)).Error; e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			txn.Rollback()
+			count = 0
+			return
+		}
+		err = txn.Commit().Error
+	}()
+
+	for _, row := range found {
+		set := []string{}
+		params := []interface{}{}
+		for i, val := range row.vals {
+			if val == nil || *val == "" {
+				continue
+			}
+			if v, ok := keyVersionOf(*val); ok && v == r.version {
+				continue
+			}
+			plain, err := decryptValue(Keys, *val)
+			if err != nil {
+				return 0, fmt.Errorf("decrypt %s.%s of %d: %w", tbl, r.cols[i], row.id, err)
+			}
+			enc, err := encryptValue(Keys, plain)
+			if err != nil {
+				return 0, err
+			}
+			set = append(set, quote(r.cols[i])+" = ?")
+			params = append(params, enc)
+		}
+		if len(set) == 0 {
+			continue
+		}
+		if r.keep != "" {
+			set = append(set, quote(r.keep)+" = "+quote(r.keep))
+		}
+		err = txn.Exec("UPDATE "+quote(tbl)+" SET "+strings.Join(set, ", ")+" WHERE "+quote(key)+" = ?", append(params, row.id)...).Error
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
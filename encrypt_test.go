@@ -0,0 +1,169 @@
+package dorm
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeyring(version string) StaticKeyring {
+	return StaticKeyring{Version: version, Keys: map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	}}
+}
+
+func TestEncryptValue(t *testing.T) {
+	ring := testKeyring("k1")
+
+	enc, err := encryptValue(ring, "4111 1111 1111 1111")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(enc, "enc:v1:k1:"))
+	version, ok := keyVersionOf(enc)
+	assert.True(t, ok)
+	assert.Equal(t, "k1", version)
+
+	again, _ := encryptValue(ring, "4111 1111 1111 1111")
+	assert.NotEqual(t, enc, again)
+
+	// decrypted with the key it was encrypted with
+	plain, err := decryptValue(testKeyring("k2"), enc)
+	assert.Nil(t, err)
+	assert.Equal(t, "4111 1111 1111 1111", plain)
+
+	plain, err = decryptValue(nil, "plain text")
+	assert.Nil(t, err)
+	assert.Equal(t, "plain text", plain)
+
+	_, err = decryptValue(nil, enc)
+	assert.Equal(t, ErrNoKeyring, err)
+	_, err = decryptValue(StaticKeyring{Version: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{9}, 32)}}, enc)
+	assert.NotNil(t, err)
+	_, err = encryptValue(StaticKeyring{Version: "k:1", Keys: map[string][]byte{"k:1": bytes.Repeat([]byte{9}, 32)}}, "x")
+	assert.NotNil(t, err)
+}
+
+func TestEncryptModel(t *testing.T) {
+	type patient struct {
+		PKey
+		Name  string  `json:"name"`
+		SSN   string  `json:"ssn" encrypt:"true"`
+		Notes *string `json:"notes" encrypt:"true"`
+	}
+	Keys = testKeyring("k1")
+	defer func() { Keys = nil }()
+
+	assert.Equal(t, []string{"ssn", "notes"}, encryptedColumns(patient{}))
+
+	data := map[string]string{"name": "ann", "ssn": "123-45-6789", "notes": NullString}
+	enc, err := encryptData(&patient{}, data)
+	assert.Nil(t, err)
+	assert.Equal(t, "123-45-6789", data["ssn"])
+	assert.Equal(t, "ann", enc["name"])
+	assert.Equal(t, NullString, enc["notes"])
+	assert.True(t, strings.HasPrefix(enc["ssn"], encPrefix))
+
+	notes, _ := encryptValue(Keys, "allergic")
+	p := patient{SSN: enc["ssn"], Notes: &notes}
+	assert.Nil(t, decryptModel(&p))
+	assert.Equal(t, "123-45-6789", p.SSN)
+	assert.Equal(t, "allergic", *p.Notes)
+
+	assert.Nil(t, decryptData(&patient{}, enc))
+	assert.Equal(t, "123-45-6789", enc["ssn"])
+}
+
+func TestLegacyEncrypt(t *testing.T) {
+	type chart struct {
+		PKey
+		Name string `json:"name"`
+		SSN  string `json:"ssn" encrypt:"true"`
+		Versioned
+		Tenanted
+	}
+	Keys = testKeyring("k1")
+	EncryptColumn = func(tbl string, field string, value string) string { return "x:" + value }
+	defer func() { Keys, EncryptColumn = nil, nil }()
+
+	// the hook skips tagged columns and those that dorm sets
+	enc, err := encryptData(&chart{}, map[string]string{"name": "ann", "ssn": "123", "version": "2", "tenant_id": "acme", "notes": NullString})
+	assert.Nil(t, err)
+	assert.Equal(t, "x:ann", enc["name"])
+	assert.True(t, strings.HasPrefix(enc["ssn"], encPrefix))
+	assert.Equal(t, "2", enc["version"])
+	assert.Equal(t, "acme", enc["tenant_id"])
+	assert.Equal(t, NullString, enc["notes"])
+}
+
+func TestDecryptMap(t *testing.T) {
+	Keys = testKeyring("k1")
+	defer func() { Keys = nil }()
+
+	ssn, _ := encryptValue(Keys, "123")
+	data := map[string]interface{}{"ssn": ssn, "note": "enc:v1:not encrypted", "n": 7}
+	assert.Nil(t, decryptMap(data, nil))
+	assert.Equal(t, "123", data["ssn"])
+	assert.Equal(t, "enc:v1:not encrypted", data["note"])
+
+	// but columns known to be encrypted fail
+	assert.NotNil(t, decryptMap(map[string]interface{}{"note": "enc:v1:not encrypted"}, map[string]bool{"note": true}))
+}
+
+type vault struct {
+	PKey
+	Secret string `json:"secret" encrypt:"true"`
+	Versioned
+	Timed
+	Historic
+}
+
+func TestRotateKeys(t *testing.T) {
+	Keys = testKeyring("k2")
+	defer func() { Keys = nil }()
+	old, _ := encryptValue(testKeyring("k1"), "s3cret")
+
+	dbo, f := newFakeDB(t)
+	f.on("SELECT DATABASE()", fakeReply{cols: []string{"db"}, rows: [][]driver.Value{{"test"}}})
+	f.on("GET_LOCK", fakeReply{cols: []string{"got"}, rows: [][]driver.Value{{int64(1)}}})
+	f.on("FROM `vault` WHERE `id` > ?", fakeReply{cols: []string{"id", "secret"}, rows: [][]driver.Value{{int64(4), old}}})
+	f.on("FROM `zoom_vault` WHERE `row_id` > ?", fakeReply{cols: []string{"row_id", "secret"}, rows: [][]driver.Value{{int64(9), old}}})
+
+	count, err := RotateKeys(dbo, &vault{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	// rows and their history are rewritten with the new key,
+	// keeping updated_at, and with the triggers standing aside
+	stmts, args := f.sent()
+	at := func(stmt string) int {
+		for i, s := range stmts {
+			if s == stmt {
+				return i
+			}
+		}
+		return -1
+	}
+	base := at("UPDATE `vault` SET `secret` = ?, `updated_at` = `updated_at` WHERE `id` = ?")
+	hist := at("UPDATE `zoom_vault` SET `secret` = ?, `updated_at` = `updated_at` WHERE `row_id` = ?")
+	if assert.True(t, base > 0 && hist > 0, stmts) {
+		assert.True(t, strings.HasPrefix(args[base][0].(string), "enc:v1:k2:"))
+		assert.Equal(t, int64(9), args[hist][1])
+		assert.Equal(t, "SET @dorm_rotate = 1", stmts[base-1])
+		assert.Equal(t, "SET @dorm_rotate = NULL", stmts[base+1])
+	}
+
+	// keys that are not integers can not be paged
+	type keyed struct {
+		ID     string `gorm:"primary_key" json:"id"`
+		Secret string `json:"secret" encrypt:"true"`
+	}
+	_, err = RotateKeys(dbo, &keyed{})
+	assert.NotNil(t, err)
+
+	Keys = StaticKeyring{Version: "k'1", Keys: map[string][]byte{"k'1": bytes.Repeat([]byte{1}, 32)}}
+	_, err = RotateKeys(dbo, &vault{})
+	assert.NotNil(t, err)
+}
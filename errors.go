@@ -0,0 +1,62 @@
+package dorm
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// Phases of database creation, population and
+// comparison, in addition to those of a schema build
+const (
+	PhaseCreateDatabase = "create database"
+	PhaseDropDatabase   = "drop database"
+	PhaseDropTable      = "drop table"
+	PhasePopulate       = "populate"
+	PhaseDiff           = "diff"
+	PhaseLock           = "lock"
+)
+
+// SchemaError tells which model (table), phase and statement
+// failed while building the schema, creating or dropping the
+// database, or populating rows
+type SchemaError struct {
+	Table     string
+	Phase     string
+	Statement string
+	Err       error
+}
+
+func (e *SchemaError) Error() string {
+	out := "dorm: " + e.Phase
+	if e.Table != "" {
+		out += " of " + e.Table
+	}
+	out += " failed: " + e.Err.Error()
+	if e.Statement != "" {
+		out += "\nstatement: " + e.Statement
+	}
+	return out
+}
+
+func (e *SchemaError) Unwrap() error {
+	return e.Err
+}
+
+// asSchemaError converts a recovered panic into a SchemaError,
+// attributing it to the given table and phase when the panic
+// carries no such detail itself. Runtime errors (nil pointers,
+// indexes out of range) are bugs, rather than failures of the
+// build, and are panicked again
+func asSchemaError(r interface{}, table string, phase string) *SchemaError {
+	switch it := r.(type) {
+	case *SchemaError:
+		return it
+	case runtime.Error:
+		panic(it)
+	case error:
+		return &SchemaError{Table: table, Phase: phase, Err: it}
+	default:
+		return &SchemaError{Table: table, Phase: phase, Err: errors.New(fmt.Sprint(it))}
+	}
+}
@@ -0,0 +1,37 @@
+package dorm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaError(t *testing.T) {
+	cause := errors.New("Duplicate key name 'idx_url_unique'")
+	err := &SchemaError{Table: "product", Phase: PhaseUniqueIndex, Statement: "CREATE UNIQUE INDEX idx_url_unique ON `product`(`url`)", Err: cause}
+
+	assert.Equal(t, "dorm: unique index of product failed: Duplicate key name 'idx_url_unique'\nstatement: CREATE UNIQUE INDEX idx_url_unique ON `product`(`url`)", err.Error())
+	assert.True(t, errors.Is(err, cause))
+}
+
+func TestAsSchemaError(t *testing.T) {
+	se := &SchemaError{Table: "a", Phase: PhaseIndex, Err: errors.New("x")}
+	assert.Equal(t, se, asSchemaError(se, "b", PhaseTrigger))
+
+	err := asSchemaError(errors.New("boom"), "product", PhaseBehavior)
+	assert.Equal(t, "product", err.Table)
+	assert.Equal(t, PhaseBehavior, err.Phase)
+
+	err = asSchemaError("SeoField field not found in model", "product", PhaseBehavior)
+	assert.Equal(t, "dorm: behavior of product failed: SeoField field not found in model", err.Error())
+
+	// bugs are not disguised as schema errors
+	assert.Panics(t, func() {
+		defer func() {
+			asSchemaError(recover(), "product", PhaseBehavior)
+		}()
+		var m map[string]int
+		m["x"] = 1
+	})
+}
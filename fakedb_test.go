@@ -0,0 +1,156 @@
+package dorm
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+// fakeReply answers a statement sent to a fakeDB
+type fakeReply struct {
+	affected int64
+	cols     []string
+	rows     [][]driver.Value
+	err      error
+}
+
+// fakeDB is a database/sql driver that records the statements
+// sent to it, and answers each with the reply of the first
+// registered substring that the statement contains (or with
+// no rows, and 1 row affected)
+type fakeDB struct {
+	mu      sync.Mutex
+	stmts   []string
+	args    [][]driver.Value
+	replies []fakeMatch
+}
+
+type fakeMatch struct {
+	contains string
+	reply    fakeReply
+}
+
+// newFakeDB returns a gorm handle (of mysql) upon a fakeDB
+func newFakeDB(t *testing.T) (*gorm.DB, *fakeDB) {
+	return newFakeDBOf(t, "mysql")
+}
+
+// newFakeDBOf returns a gorm handle of the dialect upon a fakeDB
+func newFakeDBOf(t *testing.T, dialect string) (*gorm.DB, *fakeDB) {
+	f := &fakeDB{}
+	dbo, err := gorm.Open(dialect, sql.OpenDB(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbo.LogMode(false)
+	dbo.SingularTable(true)
+	return dbo, f
+}
+
+// on registers the reply to statements that contain the substring
+func (f *fakeDB) on(contains string, reply fakeReply) *fakeDB {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replies = append(f.replies, fakeMatch{contains, reply})
+	return f
+}
+
+// sent returns the statements sent, and their parameters
+func (f *fakeDB) sent() ([]string, [][]driver.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.stmts...), append([][]driver.Value{}, f.args...)
+}
+
+// find returns the first statement sent that contains the
+// substring, along with its parameters
+func (f *fakeDB) find(contains string) (string, []driver.Value, bool) {
+	stmts, args := f.sent()
+	for i, s := range stmts {
+		if strings.Contains(s, contains) {
+			return s, args[i], true
+		}
+	}
+	return "", nil, false
+}
+
+func (f *fakeDB) answer(query string, args []driver.Value) fakeReply {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stmts = append(f.stmts, query)
+	f.args = append(f.args, args)
+	for _, m := range f.replies {
+		if strings.Contains(query, m.contains) {
+			return m.reply
+		}
+	}
+	return fakeReply{affected: 1}
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	r := s.db.answer(s.query, args)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return fakeResult(r.affected), nil
+}
+
+type fakeResult int64
+
+func (r fakeResult) LastInsertId() (int64, error) { return 1, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	r := s.db.answer(s.query, args)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &fakeRows{cols: r.cols, rows: r.rows}, nil
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,325 @@
+package dorm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/rutl/conv"
+	"github.com/rightjoin/rutl/refl"
+)
+
+// referential actions allowed on a foreign key
+var fkActions = map[string]bool{
+	"RESTRICT":  true,
+	"CASCADE":   true,
+	"SET NULL":  true,
+	"NO ACTION": true,
+}
+
+// foreignKeyDef is a foreign key declared on a model
+type foreignKeyDef struct {
+	Name       string
+	Columns    []string
+	RefTable   string
+	RefColumns []string
+	OnDelete   string
+	OnUpdate   string
+
+	// soft delete (and restore) the rows along
+	// with the referenced row, by trigger
+	SoftCascade bool
+}
+
+// dest returns the referenced table and columns,
+// in the form table_name(identity_key)
+func (f foreignKeyDef) dest() string {
+	return f.RefTable + "(" + strings.Join(f.RefColumns, ",") + ")"
+}
+
+func (f foreignKeyDef) String() string {
+	return fmt.Sprintf("(%s) references %s on delete %s on update %s", strings.Join(f.Columns, ","), f.dest(), strings.ToUpper(f.OnDelete), strings.ToUpper(f.OnUpdate))
+}
+
+// parseForeignKey reads the fk tag of the field (of the given
+// table). The tag names the referenced table and columns, and
+// may be followed by options, separated by semicolons:
+// fk:"table_name(identity_key)"
+// fk:"table_name(identity_key);on_delete:cascade;on_update:set null"
+// fk:"table_name(key1,key2);columns:col1,col2;name:fk_name"
+// fk:"table_name(identity_key);soft_cascade"
+// on_delete and on_update accept restrict (default), cascade,
+// set null and no action. columns lists the local columns of a
+// composite key (defaults to the tagged field), and name sets
+// the constraint name (defaults to a generated one). With
+// soft_cascade, rows are soft deleted (and restored) along with
+// the referenced row; both models must compose a SoftDelete
+func parseForeignKey(tbl string, column string, tag string) (foreignKeyDef, error) {
+	parts := strings.Split(tag, ";")
+	dest := strings.TrimSpace(parts[0])
+
+	fk := foreignKeyDef{
+		Columns:  []string{column},
+		RefTable: dest,
+		OnDelete: "RESTRICT",
+		OnUpdate: "RESTRICT",
+	}
+
+	if lbrace := strings.Index(dest, "("); lbrace != -1 && strings.HasSuffix(dest, ")") {
+		fk.RefTable = strings.TrimSpace(dest[:lbrace])
+		fk.RefColumns = splitColumns(dest[lbrace+1 : len(dest)-1])
+	}
+	if fk.RefTable == "" || len(fk.RefColumns) == 0 {
+		return fk, fmt.Errorf("fk on %s.%s must be of the form table_name(identity_key): %s", tbl, column, tag)
+	}
+
+	for _, opt := range parts[1:] {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		key, val := opt, ""
+		if colon := strings.Index(opt, ":"); colon != -1 {
+			key, val = strings.TrimSpace(opt[:colon]), strings.TrimSpace(opt[colon+1:])
+		}
+
+		switch strings.ToLower(key) {
+		case "on_delete", "on_update":
+			action := strings.ToUpper(strings.Join(strings.Fields(strings.Replace(val, "_", " ", -1)), " "))
+			if !fkActions[action] {
+				return fk, fmt.Errorf("fk on %s.%s has unsupported action: %s", tbl, column, val)
+			}
+			if strings.ToLower(key) == "on_delete" {
+				fk.OnDelete = action
+			} else {
+				fk.OnUpdate = action
+			}
+		case "columns":
+			fk.Columns = splitColumns(val)
+		case "name":
+			fk.Name = val
+		case "soft_cascade":
+			fk.SoftCascade = true
+		default:
+			return fk, fmt.Errorf("fk on %s.%s has unknown option: %s", tbl, column, opt)
+		}
+	}
+
+	if len(fk.Columns) != len(fk.RefColumns) {
+		return fk, fmt.Errorf("fk on %s.%s has %d columns, but references %d", tbl, column, len(fk.Columns), len(fk.RefColumns))
+	}
+
+	return fk, nil
+}
+
+func splitColumns(csv string) []string {
+	out := []string{}
+	for _, c := range strings.Split(csv, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// modelForeignKeys returns the foreign keys declared with the
+// fk tag on the model, including those on embedded structs
+func modelForeignKeys(dbo *gorm.DB, model interface{}) []foreignKeyDef {
+	tbl := Table(model)
+	out := []foreignKeyDef{}
+	for _, fld := range refl.NestedFields(model) {
+		tag := fld.Tag.Get("fk")
+		if len(tag) == 0 {
+			continue
+		}
+		fk, err := parseForeignKey(tbl, conv.CaseSnake(fld.Name), tag)
+		if err != nil {
+			panic(err)
+		}
+		if fk.SoftCascade && !isSoftDelete(model) {
+			panic(fmt.Errorf("fk on %s.%s is soft_cascade, but %s does not soft delete", tbl, conv.CaseSnake(fld.Name), tbl))
+		}
+		// the trigger could not update the
+		// table it is fired upon (mysql)
+		if fk.SoftCascade && fk.RefTable == tbl {
+			panic(fmt.Errorf("fk on %s.%s is soft_cascade, but references its own table", tbl, conv.CaseSnake(fld.Name)))
+		}
+		// generated names stay compatible with those
+		// of keys created by earlier versions
+		if fk.Name == "" {
+			dest := strings.TrimSpace(strings.Split(tag, ";")[0])
+			fk.Name = dbo.Dialect().BuildKeyName(tbl, strings.Join(fk.Columns, ","), dest, "foreign")
+		}
+		out = append(out, fk)
+	}
+	return out
+}
+
+// schemaForeignKey is a row of a foreign
+// key, as read from INFORMATION_SCHEMA
+type schemaForeignKey struct {
+	Name      string `gorm:"column:CONSTRAINT_NAME"`
+	Column    string `gorm:"column:COLUMN_NAME"`
+	RefTable  string `gorm:"column:REFERENCED_TABLE_NAME"`
+	RefColumn string `gorm:"column:REFERENCED_COLUMN_NAME"`
+	OnDelete  string `gorm:"column:DELETE_RULE"`
+	OnUpdate  string `gorm:"column:UPDATE_RULE"`
+}
+
+// liveForeignKeys returns the foreign keys present on the
+// table, keyed by name, along with the names in order
+func liveForeignKeys(dbo *gorm.DB, tbl string) (map[string]foreignKeyDef, []string) {
+	var rows []schemaForeignKey
+	err := dbo.Raw(`SELECT k.CONSTRAINT_NAME, k.COLUMN_NAME, k.REFERENCED_TABLE_NAME, k.REFERENCED_COLUMN_NAME, r.DELETE_RULE, r.UPDATE_RULE
+		FROM INFORMATION_SCHEMA.KEY_COLUMN_USAGE k
+		JOIN INFORMATION_SCHEMA.REFERENTIAL_CONSTRAINTS r
+			ON r.CONSTRAINT_SCHEMA = k.CONSTRAINT_SCHEMA AND r.CONSTRAINT_NAME = k.CONSTRAINT_NAME
+		WHERE k.TABLE_SCHEMA = DATABASE() AND k.TABLE_NAME = ? AND k.REFERENCED_TABLE_NAME IS NOT NULL
+		ORDER BY k.CONSTRAINT_NAME, k.ORDINAL_POSITION`, tbl).Scan(&rows).Error
+	if err != nil {
+		panic(err)
+	}
+
+	live := map[string]foreignKeyDef{}
+	order := []string{}
+	for _, r := range rows {
+		fk, ok := live[r.Name]
+		if !ok {
+			order = append(order, r.Name)
+			fk = foreignKeyDef{Name: r.Name, RefTable: r.RefTable, OnDelete: r.OnDelete, OnUpdate: r.OnUpdate}
+		}
+		fk.Columns = append(fk.Columns, r.Column)
+		fk.RefColumns = append(fk.RefColumns, r.RefColumn)
+		live[r.Name] = fk
+	}
+	return live, order
+}
+
+// setupForeignKeys configures the foreign keys declared on the
+// model in the underlying db. A key whose definition has changed
+// (say its referential actions) is dropped and added again
+func (b *schemaBuilder) setupForeignKeys(model interface{}) {
+	tbl := Table(model)
+	dialect := b.dbo.Dialect()
+
+	live := map[string]foreignKeyDef{}
+	if b.hasTable(tbl) {
+		live, _ = b.sql.liveForeignKeys(b.dbo, tbl)
+	}
+
+	for _, fk := range modelForeignKeys(b.dbo, model) {
+		if l, ok := live[fk.Name]; ok {
+			// keys whose definition is not read
+			// (postgres) are matched by name alone
+			if l.Columns == nil || l.String() == fk.String() {
+				continue
+			}
+			b.exec(tbl, PhaseForeignKey, b.sql.dropForeignKey(tbl, fk.Name))
+		}
+
+		cols := make([]string, len(fk.Columns))
+		for i := range fk.Columns {
+			cols[i] = dialect.Quote(fk.Columns[i])
+		}
+		b.exec(tbl, PhaseForeignKey, fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s ON DELETE %s ON UPDATE %s;",
+			dialect.Quote(tbl), dialect.Quote(fk.Name), strings.Join(cols, ","), fk.dest(), fk.OnDelete, fk.OnUpdate))
+	}
+
+	// soft cascades are triggers upon the referenced table
+	current := map[string]bool{}
+	for _, fk := range modelForeignKeys(b.dbo, model) {
+		if fk.SoftCascade {
+			b.trigger(fk.RefTable, PhaseForeignKey, b.sql.softCascade(tbl, fk))
+			current[softCascadeName(tbl, fk)] = true
+		}
+	}
+
+	// and those whose tag has gone are dropped
+	cols := map[string]bool{}
+	for _, c := range b.modelColumns(model) {
+		cols[c.Name] = true
+	}
+	names := []string{}
+	for key := range b.versions {
+		name := strings.TrimPrefix(key, ObjectTrigger+":")
+		if name != key && !current[name] && isSoftCascadeOf(name, tbl, cols) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ref := b.entities[ObjectTrigger+":"+name]
+		if b.sql.hasTrigger(b.dbo, name) {
+			b.exec(ref, PhaseForeignKey, b.sql.dropTrigger(name, ref))
+		}
+		b.forget(ref, PhaseForeignKey, ObjectTrigger, name)
+	}
+}
+
+// checkSoftCascades panics unless the tables referenced by the
+// soft cascades of the model soft delete: the model of the table,
+// if among those built, else the live table must have a deleted
+// column. Tables that do not exist are left to the foreign key
+func (b *schemaBuilder) checkSoftCascades(model interface{}, models []interface{}) {
+	tbl := Table(model)
+	for _, fk := range modelForeignKeys(b.dbo, model) {
+		if !fk.SoftCascade {
+			continue
+		}
+		soft, known := false, false
+		for _, m := range models {
+			if Table(m) == fk.RefTable {
+				soft, known = isSoftDelete(m), true
+				break
+			}
+		}
+		if !known {
+			if !b.hasTable(fk.RefTable) {
+				continue
+			}
+			cols, err := b.sql.columns(b.dbo, fk.RefTable)
+			if err != nil {
+				panic(err)
+			}
+			for _, c := range cols {
+				soft = soft || c.Name == "deleted"
+			}
+		}
+		if !soft {
+			panic(fmt.Errorf("fk on %s(%s) is soft_cascade, but %s does not soft delete", tbl, strings.Join(fk.Columns, ","), fk.RefTable))
+		}
+	}
+}
+
+// softCascadeName is the name of the trigger
+// that soft deletes the rows along with the
+// referenced row
+func softCascadeName(tbl string, fk foreignKeyDef) string {
+	return tbl + "_" + strings.Join(fk.Columns, "_") + "_soft_cascade"
+}
+
+// isSoftCascadeOf tells if the trigger name is that of a soft
+// cascade of the table, upon (some of) the given columns. The
+// columns tell the cascades of order_item from those of order
+func isSoftCascadeOf(name string, tbl string, cols map[string]bool) bool {
+	if !strings.HasPrefix(name, tbl+"_") || !strings.HasSuffix(name, "_soft_cascade") {
+		return false
+	}
+	rest := strings.TrimSuffix(strings.TrimPrefix(name, tbl+"_"), "_soft_cascade")
+	return isColumnList(rest, cols)
+}
+
+// isColumnList tells if s is a list of the
+// columns, joined by underscores
+func isColumnList(s string, cols map[string]bool) bool {
+	if cols[s] {
+		return true
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '_' && cols[s[:i]] && isColumnList(s[i+1:], cols) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package dorm
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForeignKey(t *testing.T) {
+	fk, err := parseForeignKey("product", "brand_id", "brand(id)")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"brand_id"}, fk.Columns)
+	assert.Equal(t, "brand(id)", fk.dest())
+	assert.Equal(t, "RESTRICT", fk.OnDelete)
+	assert.Equal(t, "RESTRICT", fk.OnUpdate)
+
+	fk, err = parseForeignKey("product", "brand_id", "brand(id); on_delete:set_null; on_update:cascade; name:fk_brand")
+	assert.Nil(t, err)
+	assert.Equal(t, "SET NULL", fk.OnDelete)
+	assert.Equal(t, "CASCADE", fk.OnUpdate)
+	assert.Equal(t, "fk_brand", fk.Name)
+	assert.Equal(t, "(brand_id) references brand(id) on delete SET NULL on update CASCADE", fk.String())
+
+	fk, err = parseForeignKey("stock", "sku", "variant(product_id, sku);columns:product_id,sku")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"product_id", "sku"}, fk.Columns)
+	assert.Equal(t, []string{"product_id", "sku"}, fk.RefColumns)
+
+	_, err = parseForeignKey("product", "brand_id", "brand")
+	assert.NotNil(t, err)
+	_, err = parseForeignKey("product", "brand_id", "brand(id);on_delete:explode")
+	assert.NotNil(t, err)
+	_, err = parseForeignKey("product", "brand_id", "brand(id);deferred")
+	assert.NotNil(t, err)
+	_, err = parseForeignKey("stock", "sku", "variant(product_id,sku)")
+	assert.NotNil(t, err)
+}
+
+func TestSoftCascade(t *testing.T) {
+	fk, err := parseForeignKey("order_item", "order_id", "order(id);soft_cascade")
+	assert.Nil(t, err)
+	assert.True(t, fk.SoftCascade)
+	assert.Equal(t, "(order_id) references order(id) on delete RESTRICT on update RESTRICT", fk.String())
+
+	sql := mysqlSQL{}.softCascade("order_item", fk)
+	assert.Equal(t, "order_item_order_id_soft_cascade", triggerName(sql))
+	assert.Contains(t, sql, "AFTER UPDATE ON `order`")
+	assert.Contains(t, sql, "UPDATE `order_item` SET deleted = 1 WHERE `order_id` = NEW.`id` AND deleted = 0")
+
+	sql = postgresSQL{}.softCascade("order_item", fk)
+	assert.Equal(t, "order_item_order_id_soft_cascade", triggerName(sql))
+	assert.Contains(t, sql, `AFTER UPDATE ON "order"`)
+}
+
+type parcel struct {
+	PKey
+	SoftDelete
+}
+
+type lot struct {
+	PKey
+	ParcelID uint `json:"parcel_id" fk:"parcel(id);soft_cascade"`
+	CrateID  uint `json:"crate_id" fk:"crate(id)"`
+	SoftDelete
+}
+
+type loop struct {
+	PKey
+	ParentID uint `json:"parent_id" fk:"loop(id);soft_cascade"`
+	SoftDelete
+}
+
+type lid struct {
+	PKey
+	BoxID uint `json:"box_id" fk:"box(id);soft_cascade"`
+	SoftDelete
+}
+
+func TestIsSoftCascadeOf(t *testing.T) {
+	cols := map[string]bool{"order_id": true, "product_id": true, "sku": true}
+	assert.True(t, isSoftCascadeOf("order_item_order_id_soft_cascade", "order_item", cols))
+	assert.True(t, isSoftCascadeOf("order_item_product_id_sku_soft_cascade", "order_item", cols))
+	assert.False(t, isSoftCascadeOf("order_item_order_id_soft_cascade", "order", cols))
+	assert.False(t, isSoftCascadeOf("order_item_order_id", "order_item", cols))
+	assert.False(t, isSoftCascadeOf("order_item_tenant_id_soft_cascade", "order_item", cols))
+}
+
+func TestCheckSoftCascades(t *testing.T) {
+	dbo, f := newFakeDB(t)
+	b := &schemaBuilder{dbo: dbo, sql: mysqlSQL{}, dryRun: true, planned: map[string]bool{}}
+
+	// self references are rejected
+	assert.Panics(t, func() { modelForeignKeys(dbo, &loop{}) })
+
+	// the referenced model must soft delete
+	assert.NotPanics(t, func() { b.checkSoftCascades(&lot{}, []interface{}{&lot{}, &parcel{}}) })
+	assert.Panics(t, func() { b.checkSoftCascades(&lid{}, []interface{}{&lid{}, &box{}}) })
+
+	// else the live table must have a deleted column
+	f.on("SHOW TABLES", fakeReply{cols: []string{"table"}, rows: [][]driver.Value{{"t"}}})
+	f.on("SHOW COLUMNS", fakeReply{cols: []string{"Field"}, rows: [][]driver.Value{{"id"}}})
+	assert.Panics(t, func() { b.checkSoftCascades(&lid{}, []interface{}{&lid{}}) })
+
+	dbo, f = newFakeDB(t)
+	b.dbo = dbo
+	f.on("SHOW TABLES", fakeReply{cols: []string{"table"}, rows: [][]driver.Value{{"t"}}})
+	f.on("SHOW COLUMNS", fakeReply{cols: []string{"Field"}, rows: [][]driver.Value{{"id"}, {"deleted"}}})
+	assert.NotPanics(t, func() { b.checkSoftCascades(&lid{}, []interface{}{&lid{}}) })
+}
+
+func TestStaleSoftCascade(t *testing.T) {
+	dbo, f := newFakeDB(t)
+	f.on("SHOW TABLES", fakeReply{cols: []string{"table"}, rows: [][]driver.Value{{"t"}}})
+	f.on("INFORMATION_SCHEMA.TRIGGERS", fakeReply{cols: []string{"count"}, rows: [][]driver.Value{{int64(1)}}})
+
+	b := &schemaBuilder{dbo: dbo, sql: mysqlSQL{}, dryRun: true, planned: map[string]bool{},
+		versions: map[string]string{
+			"trigger:lot_crate_id_soft_cascade":       "x",
+			"trigger:lot_item_parcel_id_soft_cascade": "x",
+		},
+		entities: map[string]string{
+			"trigger:lot_crate_id_soft_cascade":       "crate",
+			"trigger:lot_item_parcel_id_soft_cascade": "parcel",
+		},
+	}
+	b.setupForeignKeys(&lot{})
+
+	// the cascade of crate_id (whose tag has gone) is dropped,
+	// while that of parcel_id is created
+	sqls := b.plan.String()
+	assert.Contains(t, sqls, "DROP TRIGGER IF EXISTS lot_crate_id_soft_cascade")
+	assert.Contains(t, sqls, "WHERE kind = 'trigger' AND name = 'lot_crate_id_soft_cascade'")
+	assert.Contains(t, sqls, "CREATE TRIGGER lot_parcel_id_soft_cascade")
+	assert.NotContains(t, sqls, "lot_item_parcel_id_soft_cascade")
+	_, ok := b.versions["trigger:lot_crate_id_soft_cascade"]
+	assert.False(t, ok)
+}
@@ -0,0 +1,282 @@
+package dorm
+
+import (
+	"regexp"
+	"strings"
+)
+
+// columns that a history table has ahead of
+// those copied from its base table
+var historyColumns = []string{"row_id", "action", "actioned_at"}
+
+var (
+	currentTimestampRegex = regexp.MustCompile(`(?i)^current_timestamp(\(\d*\))?$`)
+	historyExtraRegex     = regexp.MustCompile(`(?i)\b(auto_increment|default_generated)\b`)
+)
+
+// historyDefinition returns the definition of the column in a
+// history table: alike that of the base table, without any
+// auto_increment, and with its default quoted as needed
+func (f showColumn) historyDefinition() string {
+	def := "`" + f.Name + "` " + f.Type
+	if f.Null == "NO" {
+		def += " NOT NULL"
+	}
+
+	if f.Default != nil {
+		switch {
+		case currentTimestampRegex.MatchString(*f.Default):
+			def += " DEFAULT " + *f.Default
+		case strings.Contains(strings.ToLower(f.Extra), "default_generated"):
+			def += " DEFAULT (" + *f.Default + ")"
+		default:
+			def += " DEFAULT " + sqlLiteral(*f.Default)
+		}
+	}
+
+	extra := strings.Join(strings.Fields(historyExtraRegex.ReplaceAllString(f.Extra, "")), " ")
+	if extra != "" {
+		def += " " + extra
+	}
+	return def
+}
+
+// baseColumns returns the columns of the model's table. The
+// live table is consulted when present, along with (in a dry-run)
+// the columns that the plan adds to it
+func (b *schemaBuilder) baseColumns(model interface{}) []showColumn {
+	tbl := Table(model)
+
+	if !b.hasTable(tbl) {
+		return b.modelColumns(model)
+	}
+
+	cols, err := b.sql.columns(b.dbo, tbl)
+	if err != nil {
+		panic(err)
+	}
+	if b.dryRun {
+		have := map[string]bool{}
+		for _, c := range cols {
+			have[c.Name] = true
+		}
+		for _, c := range b.modelColumns(model) {
+			if !have[c.Name] {
+				cols = append(cols, c)
+			}
+		}
+	}
+	return cols
+}
+
+// modelColumns returns the columns of the model, as
+// they would be created by AutoMigrate
+func (b *schemaBuilder) modelColumns(model interface{}) []showColumn {
+	scope := b.dbo.NewScope(model)
+	cols := []showColumn{}
+	for _, field := range scope.GetModelStruct().StructFields {
+		if !field.IsNormal {
+			continue
+		}
+		c := showColumn{Name: field.DBName, Type: scope.Dialect().DataTypeOf(field), Null: "YES"}
+		if field.IsPrimaryKey {
+			c.Key = "PRI"
+		}
+		if _, ok := field.TagSettingsGet("AUTO_INCREMENT"); ok {
+			c.Extra = "auto_increment"
+		}
+		cols = append(cols, c)
+	}
+	return cols
+}
+
+func (b *schemaBuilder) setupHistoricAuditLog(model interface{}) {
+
+	tbl := Table(model)
+	hist := historyPrefix + tbl
+
+	// the history table is created alike the base table, so
+	// its columns (and keys) are read off the base table
+	cols := b.baseColumns(model)
+	sum := columnsChecksum(cols)
+
+	if b.hasTable(hist) {
+
+		// never rebuild an existing history table, as it
+		// would lose the audit trail; alter it instead
+		if !b.isCurrent(ObjectHistory, hist, sum) {
+			have, err := b.sql.columns(b.dbo, hist)
+			if err != nil {
+				panic(err)
+			}
+			for _, stmt := range b.sql.syncHistory(hist, cols, have) {
+				b.exec(tbl, PhaseHistory, stmt)
+			}
+			b.record(tbl, PhaseHistory, ObjectHistory, hist, sum)
+		}
+
+	} else {
+
+		for _, stmt := range b.sql.createHistory(tbl, hist, cols) {
+			b.exec(tbl, PhaseHistory, stmt)
+		}
+		b.record(tbl, PhaseHistory, ObjectHistory, hist, sum)
+	}
+
+	// setup triggers on original/base table. They list
+	// the columns, so they are recreated as these change
+	names := make([]string, len(cols))
+	for i := range cols {
+		names[i] = cols[i].Name
+	}
+	for _, t := range b.sql.auditTriggers(tbl, names) {
+		b.trigger(tbl, PhaseHistory, t)
+	}
+
+}
+
+// mysqlCreateHistory returns the statements that create the
+// history table alike its base table, less the auto_increment
+// and primary key, and with row_id, action and actioned_at
+// ahead of the copied columns
+func mysqlCreateHistory(tbl string, hist string, cols []showColumn) []string {
+	out := []string{}
+	add := func(inp string) {
+		inp = strings.Replace(inp, "<<Table>>", hist, -1)
+		inp = strings.Replace(inp, "<<TableOrig>>", tbl, -1)
+		out = append(out, inp)
+	}
+
+	// create table alike
+	add("CREATE TABLE <<Table>> LIKE <<TableOrig>>;")
+
+	// remove auto increment (if any)
+	primary := false
+	for _, f := range cols {
+		if strings.Contains(strings.ToLower(f.Extra), "auto_increment") {
+			add("ALTER TABLE <<Table>> MODIFY " + strings.Replace(strings.Replace(f.definition(), "auto_increment", "", -1), "AUTO_INCREMENT", "", -1))
+		}
+		if f.Key == "PRI" {
+			primary = true
+		}
+	}
+
+	// drop primary key (if any)
+	if primary {
+		add("ALTER TABLE <<Table>> DROP PRIMARY KEY")
+	}
+
+	// add columns: row_id, action and actioned_at
+	add("ALTER TABLE <<Table>> ADD COLUMN row_id bigint unsigned first, ADD COLUMN action varchar(6) not null default 'insert' after row_id, ADD COLUMN actioned_at DATETIME not null default current_timestamp after action")
+
+	// set primary key and auto_increment on row_id
+	add("ALTER TABLE <<Table>> ADD PRIMARY KEY (row_id)")
+	add("ALTER TABLE <<Table>> MODIFY COLUMN row_id BIGINT UNSIGNED auto_increment")
+
+	return out
+}
+
+// mysqlSyncHistory returns the statement that alters the history
+// table (with the columns it has) to match the columns of its base
+// table: missing columns are added, and changed or misplaced ones
+// are modified. Columns since dropped from the base table are kept
+// (with their audit trail), but made nullable
+func mysqlSyncHistory(hist string, cols []showColumn, have []showColumn) []string {
+	current := map[string]showColumn{}
+	order := []string{}
+	for _, c := range have {
+		current[c.Name] = c
+		order = append(order, c.Name)
+	}
+
+	base := map[string]bool{}
+	for _, c := range historyColumns {
+		base[c] = true
+	}
+
+	clauses := []string{}
+	prev := historyColumns[len(historyColumns)-1]
+	for i, c := range cols {
+		base[c.Name] = true
+		want := c.historyDefinition()
+		pos := len(historyColumns) + i
+
+		h, ok := current[c.Name]
+		switch {
+		case !ok:
+			clauses = append(clauses, "ADD COLUMN "+want+" AFTER `"+prev+"`")
+			order = moveColumn(order, c.Name, pos)
+		case pos >= len(order) || order[pos] != c.Name || h.historyDefinition() != want:
+			clauses = append(clauses, "MODIFY COLUMN "+want+" AFTER `"+prev+"`")
+			order = moveColumn(order, c.Name, pos)
+		}
+		prev = c.Name
+	}
+
+	for _, c := range have {
+		if !base[c.Name] && c.Null == "NO" {
+			c.Null = "YES"
+			clauses = append(clauses, "MODIFY COLUMN "+c.historyDefinition())
+		}
+	}
+
+	if len(clauses) == 0 {
+		return nil
+	}
+	return []string{"ALTER TABLE " + hist + " " + strings.Join(clauses, ", ")}
+}
+
+// moveColumn moves (or inserts) the named column
+// to the given position in the list
+func moveColumn(order []string, name string, pos int) []string {
+	out := []string{}
+	for _, o := range order {
+		if o != name {
+			out = append(out, o)
+		}
+	}
+	if pos > len(out) {
+		pos = len(out)
+	}
+	out = append(out[:pos], append([]string{name}, out[pos:]...)...)
+	return out
+}
+
+// mysqlAuditTriggers returns the triggers on the base table
+// that copy every change into its history table
+func mysqlAuditTriggers(tbl string, cols []string) []string {
+	out := []string{
+		`CREATE TRIGGER <<TableOrig>>_audit_trail_insert AFTER INSERT ON <<TableOrig>> FOR EACH ROW
+        INSERT INTO <<Table>> (<<Columns>>) SELECT null,'insert',NOW(), <<Values>>
+        FROM <<TableOrig>> as src WHERE src.id = NEW.id;`,
+
+		// unless rotating keys (see RotateKeys)
+		`CREATE TRIGGER <<TableOrig>>_audit_trail_update AFTER UPDATE ON <<TableOrig>> FOR EACH ROW
+        IF COALESCE(@dorm_rotate, 0) = 0 THEN
+            INSERT INTO <<Table>> (<<Columns>>) SELECT null,'update',NOW(), <<Values>>
+            FROM <<TableOrig>> as src WHERE src.id = NEW.id;
+        END IF;`,
+
+		`CREATE TRIGGER <<TableOrig>>_audit_trail_delete BEFORE DELETE ON <<TableOrig>> FOR EACH ROW
+        INSERT INTO <<Table>> (<<Columns>>) SELECT null,'delete',NOW(), <<Values>>
+        FROM <<TableOrig>> as src WHERE src.id = OLD.id;`,
+	}
+
+	names := append([]string{}, historyColumns...)
+	values := []string{}
+	for _, c := range cols {
+		names = append(names, c)
+		values = append(values, "src.`"+c+"`")
+	}
+	for i := range names {
+		names[i] = "`" + names[i] + "`"
+	}
+
+	for i := range out {
+		out[i] = strings.Replace(out[i], "<<Table>>", historyPrefix+tbl, -1)
+		out[i] = strings.Replace(out[i], "<<TableOrig>>", tbl, -1)
+		out[i] = strings.Replace(out[i], "<<Columns>>", strings.Join(names, ", "), -1)
+		out[i] = strings.Replace(out[i], "<<Values>>", strings.Join(values, ", "), -1)
+	}
+	return out
+}
@@ -0,0 +1,461 @@
+package dorm
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/rutl/conv"
+	"github.com/rightjoin/rutl/refl"
+)
+
+// ErrNotHistoric is returned when the history of a
+// model that does not compose Historic is asked for
+var ErrNotHistoric = errors.New("model does not keep history")
+
+// Version is a row of a model, as recorded in its
+// history table by an insert, update or delete
+type Version struct {
+	RowID      uint64      `json:"row_id"`
+	Action     string      `json:"action"`
+	ActionedAt time.Time   `json:"actioned_at"`
+	Data       interface{} `json:"data"`
+}
+
+// versionMeta are the columns that a history
+// table adds to those of its base table
+type versionMeta struct {
+	RowID      uint64    `gorm:"column:row_id"`
+	Action     string    `gorm:"column:action"`
+	ActionedAt time.Time `gorm:"column:actioned_at"`
+}
+
+// History returns every recorded version of the row with the
+// given id, oldest first. Data of each version is a pointer to
+// a new instance of the model, as the row was after the action
+// (or before it, for a delete)
+func History(dbo *gorm.DB, addr interface{}, id interface{}) ([]Version, error) {
+	if !isHistoric(addr) {
+		return nil, ErrNotHistoric
+	}
+
+	tenant, params, err := tenantWhere(dbo, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := dbo.Raw("SELECT * FROM "+historyPrefix+Table(addr)+" WHERE id = ?"+tenant+" ORDER BY row_id", append([]interface{}{id}, params...)...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Version{}
+	for rows.Next() {
+		data := reflect.New(reflect.TypeOf(addr).Elem()).Interface()
+		meta, err := scanVersion(dbo, rows, data)
+		if err != nil {
+			return nil, err
+		}
+		if err = decryptModel(data); err != nil {
+			return nil, err
+		}
+		out = append(out, Version{RowID: meta.RowID, Action: meta.Action, ActionedAt: meta.ActionedAt, Data: data})
+	}
+
+	return out, rows.Err()
+}
+
+// AsOf loads into addr the row with the given id, as it was at
+// the given instant. gorm.ErrRecordNotFound is returned if the
+// row did not exist then (or had been deleted, in which case
+// addr is left as it was). The instant is compared with
+// actioned_at, which is in the time zone of the database session
+func AsOf(dbo *gorm.DB, addr interface{}, id interface{}, at time.Time) error {
+	if !isHistoric(addr) {
+		return ErrNotHistoric
+	}
+
+	tenant, params, err := tenantWhere(dbo, addr)
+	if err != nil {
+		return err
+	}
+
+	rows, err := dbo.Raw("SELECT * FROM "+historyPrefix+Table(addr)+" WHERE id = ? AND actioned_at <= ?"+tenant+" ORDER BY row_id DESC LIMIT 1", append([]interface{}{id, at}, params...)...).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		return gorm.ErrRecordNotFound
+	}
+
+	meta := versionMeta{}
+	if err = dbo.ScanRows(rows, &meta); err != nil {
+		return err
+	}
+	if meta.Action == "delete" {
+		return gorm.ErrRecordNotFound
+	}
+	if err = dbo.ScanRows(rows, addr); err != nil {
+		return err
+	}
+	return decryptModel(addr)
+}
+
+// scanVersion reads the current history row into
+// the model, and returns its history columns
+func scanVersion(dbo *gorm.DB, rows *sql.Rows, addr interface{}) (versionMeta, error) {
+	meta := versionMeta{}
+	if err := dbo.ScanRows(rows, &meta); err != nil {
+		return meta, err
+	}
+	err := dbo.ScanRows(rows, addr)
+	return meta, err
+}
+
+// Change is the change of a single field by an update. Fields
+// of json columns are diffed key by key, and are named by their
+// path, such as info.brand. Old and New hold the column values
+// as strings (nil for NULL), or the decoded json values
+type Change struct {
+	RowID      uint64      `json:"row_id"`
+	ActionedAt time.Time   `json:"actioned_at"`
+	Field      string      `json:"field"`
+	Old        interface{} `json:"old"`
+	New        interface{} `json:"new"`
+	Who        *JDoc       `json:"who"`
+}
+
+// columns that change with every update, and
+// are hence left out of the changelog
+var changelogSkip = map[string]bool{
+	"row_id":      true,
+	"action":      true,
+	"actioned_at": true,
+	"who":         true,
+	"updated_at":  true,
+}
+
+// Changelog returns the changes made to the row with the given
+// id by each update, oldest first, along with the who (if the
+// model records it) that made each change
+func Changelog(dbo *gorm.DB, addr interface{}, id interface{}) ([]Change, error) {
+	if !isHistoric(addr) {
+		return nil, ErrNotHistoric
+	}
+
+	tenant, params, err := tenantWhere(dbo, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := dbo.Raw("SELECT * FROM "+historyPrefix+Table(addr)+" WHERE id = ?"+tenant+" ORDER BY row_id", append([]interface{}{id}, params...)...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := map[string]bool{}
+	for _, c := range cryptOf(addr).columns {
+		encrypted[c] = true
+	}
+
+	out := []Change{}
+	var prev []sql.NullString
+	for rows.Next() {
+		meta := versionMeta{}
+		if err := dbo.ScanRows(rows, &meta); err != nil {
+			return nil, err
+		}
+		vals := make([]sql.NullString, len(types))
+		ptrs := make([]interface{}, len(types))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+
+		// encrypted values differ with every version,
+		// so they are compared once decrypted
+		for i, t := range types {
+			if encrypted[t.Name()] && vals[i].Valid {
+				if vals[i].String, err = decryptValue(Keys, vals[i].String); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if meta.Action == "update" && prev != nil {
+			var who *JDoc
+			changes := []fieldChange{}
+			for i, t := range types {
+				name := t.Name()
+				if name == "who" && vals[i].Valid {
+					who = NewJDoc()
+					json.Unmarshal([]byte(vals[i].String), who)
+				}
+				if changelogSkip[name] {
+					continue
+				}
+				changes = append(changes, diffColumn(name, strings.EqualFold(t.DatabaseTypeName(), "JSON"), prev[i], vals[i])...)
+			}
+			for _, c := range changes {
+				out = append(out, Change{RowID: meta.RowID, ActionedAt: meta.ActionedAt, Field: c.Field, Old: c.Old, New: c.New, Who: who})
+			}
+		}
+		prev = vals
+	}
+
+	return out, rows.Err()
+}
+
+// fieldChange is a changed field, with its old and new values
+type fieldChange struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+// diffColumn compares the old and new values of a column.
+// Json values are compared key by key
+func diffColumn(name string, isJSON bool, old sql.NullString, new sql.NullString) []fieldChange {
+	if old == new {
+		return nil
+	}
+
+	if isJSON {
+		var o, n interface{}
+		if old.Valid && json.Unmarshal([]byte(old.String), &o) != nil {
+			o = old.String
+		}
+		if new.Valid && json.Unmarshal([]byte(new.String), &n) != nil {
+			n = new.String
+		}
+		return diffJSON(name, o, n)
+	}
+
+	return []fieldChange{{Field: name, Old: nullable(old), New: nullable(new)}}
+}
+
+// diffJSON compares two decoded json values. Objects are
+// compared key by key (recursively), and other values whole
+func diffJSON(path string, old interface{}, new interface{}) []fieldChange {
+	om, ok1 := old.(map[string]interface{})
+	nm, ok2 := new.(map[string]interface{})
+	if !ok1 || !ok2 {
+		if reflect.DeepEqual(old, new) {
+			return nil
+		}
+		return []fieldChange{{Field: path, Old: old, New: new}}
+	}
+
+	keys := []string{}
+	for k := range om {
+		keys = append(keys, k)
+	}
+	for k := range nm {
+		if _, ok := om[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	out := []fieldChange{}
+	for _, k := range keys {
+		out = append(out, diffJSON(path+"."+k, om[k], nm[k])...)
+	}
+	return out
+}
+
+func nullable(s sql.NullString) interface{} {
+	if !s.Valid {
+		return nil
+	}
+	return s.String
+}
+
+// Restore writes a version of the row with the given id back to
+// the base table: the version recorded as rowID, or (when rowID
+// is 0) the snapshot taken as the row was last deleted. A row that
+// exists (for the tenant of the handle, of Tenanted models) is
+// updated, and a deleted one is inserted again with its id.
+// Fields are validated as by Update and Insert. For models
+// composed of WhosThat, the who (as from WhoStr or WhoProc, else
+// that of the handle, else that of this process) is recorded
+// along with the version restored. The restored row is read
+// into addr
+func Restore(dbo *gorm.DB, addr interface{}, id interface{}, rowID uint64, who ...string) error {
+	if !isHistoric(addr) {
+		return ErrNotHistoric
+	}
+	tbl := Table(addr)
+	tenant, tenantParams, err := tenantWhere(dbo, addr)
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT * FROM " + historyPrefix + tbl + " WHERE id = ? AND row_id = ?" + tenant
+	params := append([]interface{}{id, rowID}, tenantParams...)
+	if rowID == 0 {
+		query = "SELECT * FROM " + historyPrefix + tbl + " WHERE id = ? AND action = 'delete'" + tenant + " ORDER BY row_id DESC LIMIT 1"
+		params = append([]interface{}{id}, tenantParams...)
+	}
+	meta, values, err := readVersion(dbo, query, params...)
+	if err != nil {
+		return err
+	}
+	if err = decryptData(addr, values); err != nil {
+		return err
+	}
+
+	quote := dbo.Dialect().Quote
+	var count int
+	if err = dbo.Raw("SELECT count(*) FROM "+quote(tbl)+" WHERE id = ?"+tenant, append([]interface{}{id}, tenantParams...)...).Row().Scan(&count); err != nil {
+		return err
+	}
+	action := "update"
+	if count == 0 {
+		action = "insert"
+	}
+
+	// fields that may be written for the action
+	data := map[string]string{}
+	for _, fld := range refl.NestedFields(addr) {
+		name := conv.CaseSnake(fld.Name)
+		if val, ok := values[name]; ok && fld.Tag.Get(action) != "no" && name != "who" {
+			data[name] = val
+		}
+	}
+
+	if refl.ComposedOf(addr, WhosThat{}) {
+		if w, ok := WhoOf(dbo); ok && len(who) == 0 {
+			who = []string{w.String()}
+		}
+		data["who"], err = restoreWho(meta, who...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ok, errs := validateModel(addr, data, action); !ok {
+		return errs[0]
+	}
+
+	run := func(txn *gorm.DB) error {
+		if action == "insert" {
+			// a deleted row returns with its own id
+			data["id"] = fmt.Sprint(id)
+			return doInsertion(txn, addr, data, false)
+		}
+		return doUpdation(txn, "id", id, addr, data, false)
+	}
+
+	txn := dbo.Begin()
+	if txn.Error != nil {
+		// transaction must already be running
+		err = run(dbo)
+	} else {
+		if err = run(txn); err != nil {
+			txn.Rollback()
+			return err
+		}
+		err = txn.Commit().Error
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = dbo.Raw("SELECT * FROM "+quote(tbl)+" WHERE id = ?"+tenant, append([]interface{}{id}, tenantParams...)...).Scan(addr).Error; err != nil {
+		return err
+	}
+	return decryptModel(addr)
+}
+
+// readVersion reads a single history row. The values of the
+// columns are formatted as expected by Insert and Update
+func readVersion(dbo *gorm.DB, query string, params ...interface{}) (versionMeta, map[string]string, error) {
+	meta := versionMeta{}
+	rows, err := dbo.Raw(query, params...).Rows()
+	if err != nil {
+		return meta, nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return meta, nil, err
+		}
+		return meta, nil, gorm.ErrRecordNotFound
+	}
+
+	if err = dbo.ScanRows(rows, &meta); err != nil {
+		return meta, nil, err
+	}
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return meta, nil, err
+	}
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	if err = rows.Scan(ptrs...); err != nil {
+		return meta, nil, err
+	}
+
+	out := map[string]string{}
+	for i, c := range cols {
+		switch it := vals[i].(type) {
+		case nil:
+			out[c] = NullString
+		case []byte:
+			out[c] = string(it)
+		case time.Time:
+			out[c] = it.Format("2006-01-02 15:04:05.999999")
+		default:
+			out[c] = fmt.Sprint(it)
+		}
+	}
+	return meta, out, nil
+}
+
+// restoreWho adds the version being restored to the given
+// who (or to that of this process, if none is given)
+func restoreWho(meta versionMeta, who ...string) (string, error) {
+	doc := map[string]interface{}{}
+	src := WhoProc("restore")
+	if len(who) > 0 && who[0] != "" {
+		src = who[0]
+	}
+	if err := json.Unmarshal([]byte(src), &doc); err != nil {
+		return "", fmt.Errorf("who must be a json document: %v", err)
+	}
+
+	doc["restore"] = map[string]interface{}{
+		"row_id":      meta.RowID,
+		"action":      meta.Action,
+		"actioned_at": meta.ActionedAt,
+	}
+
+	b, err := json.Marshal(doc)
+	return string(b), err
+}
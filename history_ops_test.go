@@ -0,0 +1,134 @@
+package dorm
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffColumn(t *testing.T) {
+	ten := sql.NullString{String: "10", Valid: true}
+	twelve := sql.NullString{String: "12", Valid: true}
+
+	assert.Nil(t, diffColumn("price", false, ten, ten))
+	assert.Equal(t, []fieldChange{{Field: "price", Old: "10", New: "12"}}, diffColumn("price", false, ten, twelve))
+	assert.Equal(t, []fieldChange{{Field: "price", Old: "10", New: nil}}, diffColumn("price", false, ten, sql.NullString{}))
+
+	old := sql.NullString{String: `{"brand":"acme","size":{"w":1,"h":2},"tags":["a"]}`, Valid: true}
+	new := sql.NullString{String: `{"brand":"acme","size":{"w":1,"h":3},"tags":["a","b"],"new":true}`, Valid: true}
+	assert.Equal(t, []fieldChange{
+		{Field: "info.new", Old: nil, New: true},
+		{Field: "info.size.h", Old: float64(2), New: float64(3)},
+		{Field: "info.tags", Old: []interface{}{"a"}, New: []interface{}{"a", "b"}},
+	}, diffColumn("info", true, old, new))
+
+	assert.Equal(t, []fieldChange{{Field: "seo", Old: nil, New: map[string]interface{}{"t": "x"}}}, diffColumn("seo", true, sql.NullString{}, sql.NullString{String: `{"t":"x"}`, Valid: true}))
+}
+
+func TestRestoreWho(t *testing.T) {
+	meta := versionMeta{RowID: 7, Action: "delete"}
+
+	who, err := restoreWho(meta, `{"user":"ops"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"restore":{"action":"delete","actioned_at":"0001-01-01T00:00:00Z","row_id":7},"user":"ops"}`, who)
+
+	who, err = restoreWho(meta)
+	assert.Nil(t, err)
+	assert.Contains(t, who, `"script":"restore"`)
+
+	_, err = restoreWho(meta, "ops")
+	assert.NotNil(t, err)
+}
+
+type gadget struct {
+	PKey
+	Name  string `sql:"TYPE:varchar(64)" json:"name"`
+	Price int    `json:"price"`
+	Historic
+}
+
+// history columns of gadget, as SELECT * returns them
+var gadgetHistory = []string{"row_id", "action", "actioned_at", "id", "name", "price"}
+
+func TestScanVersion(t *testing.T) {
+	at := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	dbo, f := newFakeDB(t)
+	f.on("zoom_gadget", fakeReply{cols: gadgetHistory, rows: [][]driver.Value{
+		{int64(3), "update", at, int64(5), "lamp", int64(12)},
+	}})
+
+	rows, err := dbo.Raw("SELECT * FROM zoom_gadget").Rows()
+	assert.Nil(t, err)
+	defer rows.Close()
+	assert.True(t, rows.Next())
+
+	g := gadget{}
+	meta, err := scanVersion(dbo, rows, &g)
+	assert.Nil(t, err)
+	assert.Equal(t, versionMeta{RowID: 3, Action: "update", ActionedAt: at}, meta)
+	assert.Equal(t, gadget{PKey: PKey{ID: 5}, Name: "lamp", Price: 12}, g)
+}
+
+func TestHistoryAndAsOf(t *testing.T) {
+	at := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	dbo, f := newFakeDB(t)
+	f.on("ORDER BY row_id DESC", fakeReply{cols: gadgetHistory, rows: [][]driver.Value{
+		{int64(4), "delete", at.Add(time.Hour), int64(5), "lamp", int64(15)},
+	}})
+	f.on("ORDER BY row_id", fakeReply{cols: gadgetHistory, rows: [][]driver.Value{
+		{int64(1), "insert", at, int64(5), "lamp", int64(10)},
+		{int64(3), "update", at, int64(5), "lamp", int64(12)},
+	}})
+
+	versions, err := History(dbo, &gadget{}, 5)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, uint64(3), versions[1].RowID)
+	assert.Equal(t, "update", versions[1].Action)
+	assert.Equal(t, 12, versions[1].Data.(*gadget).Price)
+
+	// the row had been deleted by then, and is not filled in
+	g := gadget{}
+	assert.Equal(t, gorm.ErrRecordNotFound, AsOf(dbo, &g, 5, at.Add(2*time.Hour)))
+	assert.Equal(t, gadget{}, g)
+
+	_, err = History(dbo, &shade{}, 5)
+	assert.Equal(t, ErrNotHistoric, err)
+}
+
+type widget struct {
+	PKey
+	Name string `sql:"TYPE:varchar(64)" json:"name"`
+	Historic
+	Tenanted
+}
+
+func TestRestoreTenant(t *testing.T) {
+	at := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	dbo, f := newFakeDB(t)
+	f.on("zoom_widget", fakeReply{cols: []string{"row_id", "action", "actioned_at", "id", "name", "tenant_id"}, rows: [][]driver.Value{
+		{int64(3), "delete", at, int64(5), "knob", "acme"},
+	}})
+	f.on("SELECT count(*)", fakeReply{cols: []string{"count"}, rows: [][]driver.Value{{int64(0)}}})
+	f.on("SELECT * FROM `widget`", fakeReply{cols: []string{"id", "name", "tenant_id"}, rows: [][]driver.Value{{int64(5), "knob", "acme"}}})
+
+	assert.Equal(t, ErrNoTenant, errors.Unwrap(Restore(dbo, &widget{}, 5, 0)))
+
+	// the row of the tenant is missing, so it is inserted again
+	w := widget{}
+	assert.Nil(t, Restore(WithTenant(dbo, "acme"), &w, 5, 0))
+	stmt, args, _ := f.find("SELECT count(*)")
+	assert.Contains(t, stmt, "SELECT count(*) FROM `widget` WHERE id = ? AND `tenant_id` = ?")
+	assert.Equal(t, []driver.Value{int64(5), "acme"}, args)
+	_, _, ok := f.find("INSERT INTO `widget`")
+	assert.True(t, ok)
+	stmt, _, _ = f.find("SELECT * FROM `widget`")
+	assert.Contains(t, stmt, "WHERE id = ? AND `tenant_id` = ?")
+	assert.Equal(t, "knob", w.Name)
+}
@@ -0,0 +1,35 @@
+package dorm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryDefinition(t *testing.T) {
+	str := "it's"
+	now := "CURRENT_TIMESTAMP"
+
+	c := showColumn{Name: "id", Type: "int(10) unsigned", Null: "NO", Key: "PRI", Extra: "auto_increment"}
+	assert.Equal(t, "`id` int(10) unsigned NOT NULL", c.historyDefinition())
+
+	c = showColumn{Name: "name", Type: "varchar(64)", Null: "YES", Default: &str}
+	assert.Equal(t, "`name` varchar(64) DEFAULT 'it''s'", c.historyDefinition())
+
+	c = showColumn{Name: "updated_at", Type: "timestamp", Null: "NO", Default: &now, Extra: "DEFAULT_GENERATED on update CURRENT_TIMESTAMP"}
+	assert.Equal(t, "`updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP on update CURRENT_TIMESTAMP", c.historyDefinition())
+}
+
+func TestMoveColumn(t *testing.T) {
+	assert.Equal(t, []string{"a", "c", "b"}, moveColumn([]string{"a", "b", "c"}, "c", 1))
+	assert.Equal(t, []string{"a", "b", "c"}, moveColumn([]string{"a", "b"}, "c", 5))
+	assert.Equal(t, []string{"b", "a"}, moveColumn([]string{"a", "b"}, "a", 1))
+}
+
+func TestAuditTriggers(t *testing.T) {
+	trigs := mysqlAuditTriggers("product", []string{"id", "name"})
+	assert.Equal(t, 3, len(trigs))
+	assert.Equal(t, "product_audit_trail_insert", triggerName(trigs[0]))
+	assert.True(t, strings.Contains(trigs[1], "INSERT INTO zoom_product (`row_id`, `action`, `actioned_at`, `id`, `name`) SELECT null,'update',NOW(), src.`id`, src.`name`"))
+}
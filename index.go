@@ -0,0 +1,400 @@
+package dorm
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/rutl/conv"
+	"github.com/rightjoin/rutl/refl"
+)
+
+// Index types, beside the regular (btree) index
+const (
+	IndexFulltext = "FULLTEXT"
+	IndexSpatial  = "SPATIAL"
+)
+
+// indexed is implemented by models that declare indexes
+// which are not attached to any one field. Each entry uses
+// the syntax of the index tag, for example
+// "idx_search(title,body);fulltext"
+// "idx_brand((CAST(info->>'$.brand' AS CHAR(64))));unique"
+type indexed interface {
+	Indexes() []string
+}
+
+// indexPart is a single key part of an index: a column (with
+// an optional prefix length and direction), or an expression
+type indexPart struct {
+	Column string
+	Length int
+	Desc   bool
+	Expr   string
+}
+
+var indexPartRegex = regexp.MustCompile(`(?i)^(\w+)\s*(?:\(\s*(\d+)\s*\))?(?:\s+(ASC|DESC))?$`)
+
+func parseIndexPart(part string) (indexPart, error) {
+	part = strings.TrimSpace(part)
+	if strings.HasPrefix(part, "(") && strings.HasSuffix(part, ")") {
+		return indexPart{Expr: part}, nil
+	}
+	m := indexPartRegex.FindStringSubmatch(part)
+	if m == nil {
+		return indexPart{}, fmt.Errorf("invalid index key part: %s", part)
+	}
+	p := indexPart{Column: m[1], Desc: strings.EqualFold(m[3], "DESC")}
+	if m[2] != "" {
+		p.Length, _ = strconv.Atoi(m[2])
+	}
+	return p, nil
+}
+
+// sql renders the key part for a CREATE INDEX statement
+func (p indexPart) sql(quote func(string) string) string {
+	if p.Expr != "" {
+		return p.Expr
+	}
+	out := quote(p.Column)
+	if p.Length > 0 {
+		out += fmt.Sprintf("(%d)", p.Length)
+	}
+	if p.Desc {
+		out += " DESC"
+	}
+	return out
+}
+
+// String describes the key part for comparison. Mysql rewrites
+// expressions when storing them, so expressions are only
+// compared by their presence
+func (p indexPart) String() string {
+	if p.Expr != "" {
+		return "(expr)"
+	}
+	out := strings.ToLower(p.Column)
+	if p.Length > 0 {
+		out += fmt.Sprintf("(%d)", p.Length)
+	}
+	if p.Desc {
+		out += " desc"
+	}
+	return out
+}
+
+// indexDef is an index declared on a model
+type indexDef struct {
+	Name   string
+	Parts  []indexPart
+	Unique bool
+	Type   string // empty, IndexFulltext or IndexSpatial
+}
+
+func (idx indexDef) String() string {
+	kind := "index"
+	if idx.Unique {
+		kind = "unique"
+	}
+	if idx.Type != "" {
+		kind = strings.ToLower(idx.Type)
+	}
+	parts := make([]string, len(idx.Parts))
+	for i := range idx.Parts {
+		parts[i] = idx.Parts[i].String()
+	}
+	return kind + "(" + strings.Join(parts, ",") + ")"
+}
+
+// create renders the CREATE INDEX statement of the index
+func (idx indexDef) create(quote func(string) string, tbl string) string {
+	kind := "INDEX"
+	if idx.Unique {
+		kind = "UNIQUE INDEX"
+	}
+	if idx.Type != "" {
+		kind = idx.Type + " INDEX"
+	}
+	parts := make([]string, len(idx.Parts))
+	for i := range idx.Parts {
+		parts[i] = idx.Parts[i].sql(quote)
+	}
+	return fmt.Sprintf("CREATE %s %v ON %v(%v)", kind, idx.Name, quote(tbl), strings.Join(parts, ", "))
+}
+
+// modelIndexes returns the indexes declared upon the model's
+// fields, and by its Indexes() method, unique indexes first.
+// The following formats are used to declare a unique index
+// unique:"true"
+// unique:"idx_name"
+// unique:"idx_name(field1,field2)"
+// and the following for a normal index
+// index:"true"
+// index:"idx_name"
+// index:"idx_name(field1,field2)"
+// A key part may carry a prefix length and a direction (which
+// mysql before 8.0 drops, and so is not compared upon), or be
+// an expression within parentheses (mysql 8):
+// index:"idx_name(url(191),created_at DESC)"
+// index:"idx_name((CAST(info->>'$.brand' AS CHAR(64))))"
+// Options follow the declaration, separated by semicolons:
+// index:"idx_name(title,body);fulltext"
+// index:"true;spatial"
+// The unique option (implied by the unique tag) is meant
+// for indexes declared through Indexes()
+func modelIndexes(model interface{}) []indexDef {
+	unique := []indexDef{}
+	normal := []indexDef{}
+	add := func(idx indexDef) {
+		if idx.Unique {
+			unique = append(unique, idx)
+		} else {
+			normal = append(normal, idx)
+		}
+	}
+
+	fields := refl.NestedFields(model)
+	for _, fld := range fields {
+		if decl := fld.Tag.Get("unique"); len(decl) > 0 {
+			idx, err := parseIndex(decl, "_unique", &fld)
+			if err != nil {
+				panic(err)
+			}
+			idx.Unique = true
+			add(idx)
+		}
+	}
+	for _, fld := range fields {
+		if decl := fld.Tag.Get("index"); len(decl) > 0 {
+			idx, err := parseIndex(decl, "", &fld)
+			if err != nil {
+				panic(err)
+			}
+			add(idx)
+		}
+	}
+
+	if m, ok := model.(indexed); ok {
+		for _, decl := range m.Indexes() {
+			idx, err := parseIndex(decl, "", nil)
+			if err != nil {
+				panic(err)
+			}
+			add(idx)
+		}
+	}
+
+	return append(unique, normal...)
+}
+
+// parseIndex reads an index declaration of the form
+// "idx_name(part1,part2);option". When no key parts are given,
+// the index is built on the tagged field itself. A name of
+// "true" is replaced with one generated from the field
+func parseIndex(decl string, suffix string, fld *reflect.StructField) (indexDef, error) {
+	segs := splitTopLevel(decl, ';')
+	head := strings.TrimSpace(segs[0])
+	idx := indexDef{Name: head}
+
+	if lbrace := strings.Index(head, "("); lbrace != -1 {
+		if !strings.HasSuffix(head, ")") {
+			return idx, fmt.Errorf("invalid index declaration: %s", decl)
+		}
+		idx.Name = strings.TrimSpace(head[:lbrace])
+		for _, p := range splitTopLevel(head[lbrace+1:len(head)-1], ',') {
+			part, err := parseIndexPart(p)
+			if err != nil {
+				return idx, err
+			}
+			idx.Parts = append(idx.Parts, part)
+		}
+	}
+
+	if fld != nil {
+		if idx.Name == "true" { // generate index name
+			idx.Name = "idx_" + conv.CaseSnake(fld.Name) + suffix
+		}
+		if len(idx.Parts) == 0 {
+			idx.Parts = []indexPart{{Column: conv.CaseSnake(fld.Name)}}
+		}
+	}
+	if idx.Name == "" || idx.Name == "true" || len(idx.Parts) == 0 {
+		return idx, fmt.Errorf("index must be named and list its key parts: %s", decl)
+	}
+
+	for _, opt := range segs[1:] {
+		switch strings.ToLower(strings.TrimSpace(opt)) {
+		case "":
+		case "unique":
+			idx.Unique = true
+		case "fulltext":
+			idx.Type = IndexFulltext
+		case "spatial":
+			idx.Type = IndexSpatial
+		default:
+			return idx, fmt.Errorf("index %s has unknown option: %s", idx.Name, opt)
+		}
+	}
+	if idx.Type != "" && (idx.Unique || suffix != "") {
+		return idx, fmt.Errorf("%s index %s cannot be unique", strings.ToLower(idx.Type), idx.Name)
+	}
+
+	return idx, nil
+}
+
+// splitTopLevel splits s on sep, ignoring separators that
+// are within parentheses or quotes
+func splitTopLevel(s string, sep byte) []string {
+	out := []string{}
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == sep && depth == 0:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+// ascending returns the index without the direction of its
+// parts, for servers that do not keep it
+func (idx indexDef) ascending() indexDef {
+	parts := make([]indexPart, len(idx.Parts))
+	for i, p := range idx.Parts {
+		p.Desc = false
+		parts[i] = p
+	}
+	idx.Parts = parts
+	return idx
+}
+
+// keepsDesc tells if the server keeps the direction of index
+// parts: mysql before 8.0 (and mariadb before 10.8) parse DESC
+// but store every part ascending (COLLATION is always 'A')
+func keepsDesc(dbo *gorm.DB) bool {
+	if dbo.Dialect().GetName() != "mysql" {
+		return true
+	}
+	var version string
+	if err := dbo.Raw("SELECT VERSION() AS version").Row().Scan(&version); err != nil {
+		return true
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(version, "%d.%d", &major, &minor); err != nil {
+		return true
+	}
+	if strings.Contains(strings.ToLower(version), "mariadb") {
+		return major > 10 || major == 10 && minor >= 8
+	}
+	return major >= 8
+}
+
+// schemaIndex is a row of an index, as read from
+// INFORMATION_SCHEMA (EXPRESSION is only present in mysql 8)
+type schemaIndex struct {
+	Name       string         `gorm:"column:INDEX_NAME"`
+	NonUnique  int            `gorm:"column:NON_UNIQUE"`
+	Column     sql.NullString `gorm:"column:COLUMN_NAME"`
+	SubPart    sql.NullInt64  `gorm:"column:SUB_PART"`
+	Collation  sql.NullString `gorm:"column:COLLATION"`
+	IndexType  string         `gorm:"column:INDEX_TYPE"`
+	Expression sql.NullString `gorm:"column:EXPRESSION"`
+}
+
+// liveIndexes returns the indexes present on the table,
+// keyed by name, along with the names in order
+func liveIndexes(dbo *gorm.DB, tbl string) (map[string]indexDef, []string) {
+	var rows []schemaIndex
+	err := dbo.Raw("SELECT * FROM INFORMATION_SCHEMA.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? ORDER BY INDEX_NAME, SEQ_IN_INDEX", tbl).Scan(&rows).Error
+	if err != nil {
+		panic(err)
+	}
+
+	live := map[string]indexDef{}
+	order := []string{}
+	for _, r := range rows {
+		idx, ok := live[r.Name]
+		if !ok {
+			order = append(order, r.Name)
+		}
+		idx.Name = r.Name
+		idx.Unique = r.NonUnique == 0
+		if r.IndexType == IndexFulltext || r.IndexType == IndexSpatial {
+			idx.Type = r.IndexType
+		}
+
+		part := indexPart{Desc: r.Collation.String == "D"}
+		if r.Column.Valid {
+			part.Column = r.Column.String
+			part.Length = int(r.SubPart.Int64)
+		} else {
+			part.Expr = "(" + r.Expression.String + ")"
+		}
+		idx.Parts = append(idx.Parts, part)
+		live[r.Name] = idx
+	}
+	return live, order
+}
+
+// setupUniqueIndexes creates the unique indexes
+// declared upon the model
+func (b *schemaBuilder) setupUniqueIndexes(model interface{}) {
+	b.addIndexes(model, PhaseUniqueIndex, true)
+}
+
+// setupIndexes creates the (non unique) indexes
+// declared upon the model
+func (b *schemaBuilder) setupIndexes(model interface{}) {
+	b.addIndexes(model, PhaseIndex, false)
+}
+
+// addIndexes creates the (unique or other) indexes of the
+// model that are missing. An index whose definition has
+// changed is dropped and created again
+func (b *schemaBuilder) addIndexes(model interface{}, phase string, unique bool) {
+	tbl := Table(model)
+
+	live := map[string]indexDef{}
+	desc := true
+	if b.hasTable(tbl) {
+		live, _ = b.sql.liveIndexes(b.dbo, tbl)
+		desc = keepsDesc(b.dbo)
+	}
+
+	for _, idx := range modelIndexes(model) {
+		if idx.Unique != unique {
+			continue
+		}
+		idx.Name = b.sql.indexName(tbl, idx.Name)
+		if l, ok := live[idx.Name]; ok {
+			// indexes whose definition is not read
+			// (postgres) are matched by name alone
+			if l.Parts == nil || l.String() == idx.String() {
+				continue
+			}
+			if !desc && l.String() == idx.ascending().String() {
+				continue
+			}
+			b.exec(tbl, phase, b.sql.dropIndex(tbl, idx.Name))
+		}
+		b.exec(tbl, phase, b.sql.createIndex(tbl, idx))
+	}
+}
@@ -0,0 +1,82 @@
+package dorm
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIndex(t *testing.T) {
+	type Abc struct {
+		FirstName string
+	}
+	fld, _ := reflect.TypeOf(Abc{}).FieldByName("FirstName")
+
+	idx, err := parseIndex("idx_first", "", &fld)
+	assert.Nil(t, err)
+	assert.Equal(t, "idx_first", idx.Name)
+	assert.Equal(t, "index(first_name)", idx.String())
+
+	idx, err = parseIndex("true", "_unique", &fld)
+	assert.Nil(t, err)
+	assert.Equal(t, "idx_first_name_unique", idx.Name)
+
+	idx, err = parseIndex("idx_pair(entity, field)", "", &fld)
+	assert.Nil(t, err)
+	assert.Equal(t, "idx_pair", idx.Name)
+	assert.Equal(t, "index(entity,field)", idx.String())
+
+	idx, err = parseIndex("idx_url(url(191), created_at DESC)", "", &fld)
+	assert.Nil(t, err)
+	assert.Equal(t, []indexPart{{Column: "url", Length: 191}, {Column: "created_at", Desc: true}}, idx.Parts)
+
+	idx, err = parseIndex("idx_search(title,body);fulltext", "", &fld)
+	assert.Nil(t, err)
+	assert.Equal(t, "fulltext(title,body)", idx.String())
+
+	idx, err = parseIndex("idx_brand((CAST(info->>'$.brand' AS CHAR(64))), id);unique", "", nil)
+	assert.Nil(t, err)
+	assert.True(t, idx.Unique)
+	assert.Equal(t, "(CAST(info->>'$.brand' AS CHAR(64)))", idx.Parts[0].Expr)
+	assert.Equal(t, "unique((expr),id)", idx.String())
+
+	_, err = parseIndex("idx_search", "", nil)
+	assert.NotNil(t, err)
+	_, err = parseIndex("idx_first;hash", "", &fld)
+	assert.NotNil(t, err)
+	_, err = parseIndex("idx_first;fulltext", "_unique", &fld)
+	assert.NotNil(t, err)
+	_, err = parseIndex("idx_bad(first name)", "", &fld)
+	assert.NotNil(t, err)
+}
+
+func TestSplitTopLevel(t *testing.T) {
+	assert.Equal(t, []string{"a", "b(c,d)", " 'e,f'"}, splitTopLevel("a,b(c,d), 'e,f'", ','))
+	assert.Equal(t, []string{"idx(a)"}, splitTopLevel("idx(a)", ';'))
+}
+
+func TestKeepsDesc(t *testing.T) {
+	type ledgerLine struct {
+		ID        uint
+		CreatedAt string `index:"idx_created(created_at DESC)"`
+	}
+
+	for version, drop := range map[string]bool{"5.7.42-log": false, "10.6.12-MariaDB": false, "8.0.35": true} {
+		dbo, f := newFakeDB(t)
+		f.on("SHOW TABLES", fakeReply{cols: []string{"table"}, rows: [][]driver.Value{{"t"}}})
+		f.on("VERSION()", fakeReply{cols: []string{"version"}, rows: [][]driver.Value{{version}}})
+		f.on("INFORMATION_SCHEMA.STATISTICS", fakeReply{
+			cols: []string{"INDEX_NAME", "NON_UNIQUE", "COLUMN_NAME", "COLLATION", "INDEX_TYPE"},
+			rows: [][]driver.Value{{"idx_created", int64(1), "created_at", "A", "BTREE"}},
+		})
+
+		// servers that store no direction keep the index
+		b := &schemaBuilder{dbo: dbo, sql: mysqlSQL{}, dryRun: true, planned: map[string]bool{}}
+		b.setupIndexes(&ledgerLine{})
+		assert.Equal(t, drop, strings.Contains(b.plan.String(), "DROP INDEX idx_created"), version)
+		assert.Equal(t, drop, len(diffIndexes(dbo, &ledgerLine{})) > 0, version)
+	}
+}
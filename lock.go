@@ -0,0 +1,305 @@
+package dorm
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/fig"
+	"github.com/rs/zerolog/log"
+)
+
+// Names of the locks taken by BuildSchema and RunMigration
+const (
+	LockSchema    = "dorm:schema"
+	LockMigration = "dorm:migration"
+)
+
+// ErrLockTimeout is returned when a lock could not
+// be acquired within the given timeout
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+// ErrLockTakeover is returned when the connection of a stale
+// holder could not be killed, which on mysql needs the
+// CONNECTION_ADMIN (or SUPER) privilege for connections of
+// other users, and on postgres pg_signal_backend
+var ErrLockTakeover = errors.New("cannot take over stale lock")
+
+// DBLock is a named lock, held across all servers that connect
+// to the same database. It is backed by mysql's GET_LOCK, held
+// upon a connection dedicated to the lock. Mysql releases the
+// lock by itself if the holder's connection is lost (say the
+// server crashes). A holder that is alive, but has stopped
+// responding, is considered stale once its lock connection
+// has been silent for longer than StaleAfter; waiting servers
+// then take the lock over by killing that connection.
+// On postgres, the lock is a session level advisory lock
+type DBLock struct {
+	Name       string
+	Timeout    time.Duration // how long to wait for the lock
+	StaleAfter time.Duration // zero never takes over a lock
+
+	key  string
+	pg   bool
+	conn *sql.Conn
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDBLock returns the named lock, with the timeout and stale
+// limit read from config (in seconds):
+// database:
+//		lock:
+//			timeout: defaults to 600
+//			stale: defaults to 300
+func NewDBLock(name string) *DBLock {
+	return &DBLock{
+		Name:       name,
+		Timeout:    time.Duration(fig.IntOr(600, "database.lock.timeout")) * time.Second,
+		StaleAfter: time.Duration(fig.IntOr(300, "database.lock.stale")) * time.Second,
+	}
+}
+
+// Acquire waits (up to Timeout) for the lock. Once acquired,
+// the lock connection is kept alive until Release is called
+func (l *DBLock) Acquire(dbo *gorm.DB) error {
+	if l.conn != nil {
+		return fmt.Errorf("lock %s is already held", l.Name)
+	}
+
+	ctx := context.Background()
+	conn, err := dbo.DB().Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	// locks are server wide, so scope them to the database
+	l.pg = dbo.Dialect().GetName() == "postgres"
+	current := "SELECT DATABASE()"
+	if l.pg {
+		current = "SELECT current_database()"
+	}
+	var dbname string
+	err = conn.QueryRowContext(ctx, current).Scan(&dbname)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	l.key = lockKey(dbname, l.Name)
+
+	deadline := time.Now().Add(l.Timeout)
+	for {
+		// wait in short slices, so that a stale holder
+		// is noticed well before the timeout
+		wait := time.Until(deadline)
+		if wait > 5*time.Second {
+			wait = 5 * time.Second
+		}
+		if wait < 0 {
+			wait = 0
+		}
+
+		got, err := l.tryLock(ctx, conn, wait)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		if got {
+			break
+		}
+
+		took, err := l.takeover(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		if took {
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			conn.Close()
+			return fmt.Errorf("%w: %s", ErrLockTimeout, l.Name)
+		}
+	}
+
+	l.conn = conn
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.heartbeat()
+
+	return nil
+}
+
+// tryLock waits (up to wait) for the lock, and tells if it got
+// it. Postgres can't wait upon an advisory lock with a timeout,
+// so it is polled instead
+func (l *DBLock) tryLock(ctx context.Context, conn *sql.Conn, wait time.Duration) (bool, error) {
+	if !l.pg {
+		var got sql.NullInt64
+		err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", l.key, int((wait+time.Second-1)/time.Second)).Scan(&got)
+		return got.Valid && got.Int64 == 1, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		var got bool
+		err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", pgLockKey(l.key)).Scan(&got)
+		if err != nil || got || !time.Now().Before(deadline) {
+			return got, err
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// takeover kills the connection of a stale holder, and tells
+// if it did so. Failing to kill it (say, for want of privilege)
+// is an error, rather than waiting out the timeout
+func (l *DBLock) takeover(ctx context.Context, conn *sql.Conn) (bool, error) {
+	if l.StaleAfter <= 0 {
+		return false, nil
+	}
+
+	var holder sql.NullInt64
+	var command string
+	var idle int64
+	if l.pg {
+		// bigint advisory locks are keyed upon classid (high
+		// half), objid (low half) and objsubid = 1
+		key := pgLockKey(l.key)
+		err := conn.QueryRowContext(ctx, `SELECT a.pid, COALESCE(a.state, ''), COALESCE(EXTRACT(EPOCH FROM now() - a.state_change), 0)::bigint
+			FROM pg_locks k JOIN pg_stat_activity a ON a.pid = k.pid
+			WHERE k.locktype = 'advisory' AND k.granted AND k.classid = $1 AND k.objid = $2 AND k.objsubid = 1`,
+			uint32(uint64(key)>>32), uint32(key)).Scan(&holder, &command, &idle)
+		if err != nil || command != "idle" || time.Duration(idle)*time.Second < l.StaleAfter {
+			return false, nil
+		}
+	} else {
+		err := conn.QueryRowContext(ctx, "SELECT IS_USED_LOCK(?)", l.key).Scan(&holder)
+		if err != nil || !holder.Valid {
+			return false, nil
+		}
+
+		err = conn.QueryRowContext(ctx, "SELECT COMMAND, TIME FROM INFORMATION_SCHEMA.PROCESSLIST WHERE ID = ?", holder.Int64).Scan(&command, &idle)
+		if err != nil || command != "Sleep" || time.Duration(idle)*time.Second < l.StaleAfter {
+			return false, nil
+		}
+	}
+
+	log.Warn().
+		Str("lock", l.Name).
+		Int64("holder", holder.Int64).
+		Int64("idle", idle).
+		Msg("lock: taking over stale lock")
+
+	kill := fmt.Sprintf("KILL %d", holder.Int64)
+	privilege := "CONNECTION_ADMIN or SUPER"
+	if l.pg {
+		kill = fmt.Sprintf("SELECT pg_terminate_backend(%d)", holder.Int64)
+		privilege = "pg_signal_backend"
+	}
+	if _, err := conn.ExecContext(ctx, kill); err != nil {
+		return false, fmt.Errorf("%w: %s is held by connection %d, idle for %ds, which needs %s to kill: %v", ErrLockTakeover, l.Name, holder.Int64, idle, privilege, err)
+	}
+	return true, nil
+}
+
+// heartbeat keeps the lock connection busy, so that
+// other servers do not consider this holder stale
+func (l *DBLock) heartbeat() {
+	defer close(l.done)
+
+	interval := l.StaleAfter / 3
+	if interval <= 0 || interval > time.Minute {
+		interval = time.Minute
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-tick.C:
+			ping := "DO 0"
+			if l.pg {
+				ping = "SELECT 1"
+			}
+			if _, err := l.conn.ExecContext(context.Background(), ping); err != nil {
+				log.Error().
+					Str("lock", l.Name).
+					Err(err).
+					Msg("lock: heartbeat failed")
+			}
+		}
+	}
+}
+
+// Release gives up the lock
+func (l *DBLock) Release() error {
+	if l.conn == nil {
+		return nil
+	}
+
+	close(l.stop)
+	<-l.done
+
+	var err error
+	if l.pg {
+		_, err = l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", pgLockKey(l.key))
+	} else {
+		_, err = l.conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", l.key)
+	}
+	l.conn.Close()
+	l.conn = nil
+	return err
+}
+
+// lockKey builds the name of the mysql lock, which
+// may not be longer than 64 characters
+func lockKey(dbname string, name string) string {
+	key := dbname + "." + name
+	if len(key) <= 64 {
+		return key
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+}
+
+// pgLockKey builds the key of the postgres advisory
+// lock, which is a bigint
+func pgLockKey(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64())
+}
+
+// WithDBLock runs fn while holding the named lock. Servers that
+// lose the race wait for the lock, and then run fn themselves;
+// fn must therefore skip work that is already done. Failing to
+// release the lock is returned, or logged if fn failed as well
+func WithDBLock(dbo *gorm.DB, name string, fn func() error) (err error) {
+	lock := NewDBLock(name)
+	if err = lock.Acquire(dbo); err != nil {
+		return err
+	}
+	defer func() {
+		rerr := lock.Release()
+		switch {
+		case rerr == nil:
+		case err == nil:
+			err = rerr
+		default:
+			log.Error().
+				Str("lock", name).
+				Err(rerr).
+				Msg("lock: release failed")
+		}
+	}()
+
+	return fn()
+}
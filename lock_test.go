@@ -0,0 +1,50 @@
+package dorm
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockKey(t *testing.T) {
+	assert.Equal(t, "dorm_testing.dorm:schema", lockKey("dorm_testing", LockSchema))
+
+	long := lockKey(strings.Repeat("x", 60), LockMigration)
+	assert.Len(t, long, 40)
+	assert.Equal(t, long, lockKey(strings.Repeat("x", 60), LockMigration))
+	assert.NotEqual(t, long, lockKey(strings.Repeat("x", 60), LockSchema))
+}
+
+func TestLockTakeover(t *testing.T) {
+	dbo, f := newFakeDB(t)
+	f.on("SELECT DATABASE()", fakeReply{cols: []string{"db"}, rows: [][]driver.Value{{"db"}}})
+	f.on("GET_LOCK", fakeReply{cols: []string{"got"}, rows: [][]driver.Value{{int64(0)}}})
+	f.on("IS_USED_LOCK", fakeReply{cols: []string{"holder"}, rows: [][]driver.Value{{int64(17)}}})
+	f.on("PROCESSLIST", fakeReply{cols: []string{"COMMAND", "TIME"}, rows: [][]driver.Value{{"Sleep", int64(900)}}})
+	f.on("KILL 17", fakeReply{err: errors.New("Error 1095: You are not owner of thread 17")})
+
+	// a stale holder that cannot be killed is reported at once
+	l := &DBLock{Name: LockSchema, Timeout: time.Minute, StaleAfter: time.Second}
+	err := l.Acquire(dbo)
+	assert.True(t, errors.Is(err, ErrLockTakeover))
+	assert.Contains(t, err.Error(), "CONNECTION_ADMIN")
+	assert.Contains(t, err.Error(), "not owner of thread 17")
+}
+
+func TestWithDBLockRelease(t *testing.T) {
+	dbo, f := newFakeDB(t)
+	f.on("SELECT DATABASE()", fakeReply{cols: []string{"db"}, rows: [][]driver.Value{{"db"}}})
+	f.on("GET_LOCK", fakeReply{cols: []string{"got"}, rows: [][]driver.Value{{int64(1)}}})
+	f.on("RELEASE_LOCK", fakeReply{err: errors.New("connection lost")})
+
+	// a failed release is returned, unless fn failed first
+	err := WithDBLock(dbo, LockSchema, func() error { return nil })
+	assert.EqualError(t, err, "connection lost")
+	failed := errors.New("failed")
+	err = WithDBLock(dbo, LockSchema, func() error { return failed })
+	assert.Equal(t, failed, err)
+}
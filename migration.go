@@ -42,7 +42,31 @@ type SQLMigration struct {
 // inside the directory mentioned in the config under the key
 // database:
 //		sql-folder: defaults to ./sql
+// The migration runs holding the cluster wide LockMigration; servers
+// that lose the race wait, and then skip the files already executed
 func RunMigration(db *gorm.DB) {
+	if err := RunMigrationE(db); err != nil {
+		panic(err)
+	}
+}
+
+// RunMigrationE is RunMigration, returning an error (rather than
+// panicking) when the migration lock can not be acquired, so that
+// the service does not boot upon a schema that was not migrated
+func RunMigrationE(db *gorm.DB) error {
+	err := WithDBLock(db, LockMigration, func() error {
+		runMigration(db)
+		return nil
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("sql: Could not acquire migration lock")
+	}
+	return err
+}
+
+func runMigration(db *gorm.DB) {
 
 	dir := fig.StringOr("./sql", "database.sql-folder")
 	fInfo := make([]os.FileInfo, 0)
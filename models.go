@@ -71,8 +71,24 @@ type Tagged struct {
 	Tags *JArrStr `sql:"TYPE:json;" json:"tags"`
 }
 
+// Versioned rows carry a version, incremented by trigger on
+// every update. Update and UpdateSelect given the "version" that
+// was read return ErrStaleVersion if the row has changed since,
+// and gorm.ErrRecordNotFound if it is missing. Data of the version
+// alone only checks it
+type Versioned struct {
+	Version uint `sql:"not null;DEFAULT:'1'" json:"version" insert:"no"`
+}
+
+// Ordered rows are appended (at the max sequence + 1) unless
+// inserted with a sequence. Rows are ordered within the scope
+// column set with a tag, if any: Ordered `scope:"parent_id"`.
+// Use MoveTo, MoveUp and MoveDown to reorder them. The trigger
+// does not lock the scope, so rows appended concurrently may
+// share a sequence: order by sequence, id (as the moves do),
+// and a move renumbers the scope without ties
 type Ordered struct {
-	Sequence uint `sql:"not null;DEFAULT:'1'" json:"sequence"`
+	Sequence uint `sql:"not null;DEFAULT:'0'" json:"sequence"`
 }
 
 type Boosted struct {
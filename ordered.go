@@ -0,0 +1,160 @@
+package dorm
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/rutl/refl"
+)
+
+// ScopeColumn returns the column within whose
+// values the rows of the model are ordered
+func (o Ordered) ScopeColumn(addr interface{}) string {
+	t := reflect.TypeOf(addr)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if sf, ok := t.FieldByName("Ordered"); ok {
+		return sf.Tag.Get("scope")
+	}
+	return ""
+}
+
+// orderedDefault returns the given statement (that sets the
+// default of sequence to 0, which appends the row) unless the
+// column already has it. Tables ordered before rows were
+// appended have a default of 1
+func orderedDefault(dbo *gorm.DB, model interface{}, cols func(tbl string) ([]showColumn, error), ddl string) []string {
+	tbl := Table(model)
+	if dbo.HasTable(tbl) {
+		flds, err := cols(tbl)
+		if err != nil {
+			panic(err)
+		}
+		for _, f := range flds {
+			if f.Name == "sequence" && f.Default != nil && *f.Default == "0" {
+				return []string{}
+			}
+		}
+	}
+	return []string{ddl}
+}
+
+// MoveTo moves the row (of the given id) to the position (from
+// 1) among the rows of its scope, and renumbers them all from 1.
+// A position past the last row moves the row to the end
+func MoveTo(dbo *gorm.DB, model interface{}, id interface{}, position int) error {
+	return reorder(dbo, model, id, func(int) int { return position })
+}
+
+// MoveUp moves the row one position up (towards 1)
+func MoveUp(dbo *gorm.DB, model interface{}, id interface{}) error {
+	return reorder(dbo, model, id, func(at int) int { return at - 1 })
+}
+
+// MoveDown moves the row one position down
+func MoveDown(dbo *gorm.DB, model interface{}, id interface{}) error {
+	return reorder(dbo, model, id, func(at int) int { return at + 1 })
+}
+
+// reorder moves the row to the position worked out from its
+// current one, within a transaction that locks its siblings
+func reorder(dbo *gorm.DB, model interface{}, id interface{}, to func(at int) int) error {
+	if !refl.ComposedOf(model, Ordered{}) {
+		return fmt.Errorf("model is not ordered: %s", Table(model))
+	}
+
+	txn := dbo.Begin()
+	if txn.Error != nil {
+		// transaction must already be running
+		return doReorder(dbo, model, id, to)
+	}
+
+	err := doReorder(txn, model, id, to)
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	return txn.Commit().Error
+}
+
+func doReorder(txn *gorm.DB, model interface{}, id interface{}, to func(at int) int) error {
+	tbl := txn.Dialect().Quote(Table(model))
+	scope := Ordered{}.ScopeColumn(model)
+	tenant, tenantParams, err := tenantWhere(txn, model)
+	if err != nil {
+		return err
+	}
+
+	// rows of the same scope, in their current order
+	var ids []uint64
+	if scope == "" {
+		if err := txn.Raw("SELECT id FROM "+tbl+" WHERE 1 = 1"+tenant+" ORDER BY sequence, id FOR UPDATE", tenantParams...).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+	} else {
+		col := txn.Dialect().Quote(scope)
+		var val interface{}
+		err := txn.Raw("SELECT "+col+" FROM "+tbl+" WHERE id = ?"+tenant, append([]interface{}{id}, tenantParams...)...).Row().Scan(&val)
+		if err == sql.ErrNoRows {
+			return gorm.ErrRecordNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		where := col + " = ?"
+		args := []interface{}{val}
+		if val == nil {
+			where, args = col+" IS NULL", nil
+		}
+		if err := txn.Raw("SELECT id FROM "+tbl+" WHERE "+where+tenant+" ORDER BY sequence, id FOR UPDATE", append(args, tenantParams...)...).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+	}
+
+	order, ok := reordered(ids, fmt.Sprint(id), to)
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+
+	for i, r := range order {
+		err := txn.Exec("UPDATE "+tbl+" SET sequence = ? WHERE id = ? AND sequence <> ?", i+1, r, i+1).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reordered takes the row out of the list, and puts it back
+// in at the position (from 1) worked out from its current one
+func reordered(ids []uint64, id string, to func(at int) int) ([]uint64, bool) {
+	at := 0
+	rest := []uint64{}
+	for i, r := range ids {
+		if fmt.Sprint(r) == id {
+			at = i + 1
+		} else {
+			rest = append(rest, r)
+		}
+	}
+	if at == 0 {
+		return nil, false
+	}
+
+	pos := to(at)
+	if pos < 1 {
+		pos = 1
+	}
+	if pos > len(ids) {
+		pos = len(ids)
+	}
+
+	out := append([]uint64{}, rest[:pos-1]...)
+	out = append(out, ids[at-1])
+	return append(out, rest[pos-1:]...), true
+}
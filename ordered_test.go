@@ -0,0 +1,56 @@
+package dorm
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReordered(t *testing.T) {
+	ids := []uint64{4, 7, 9, 12}
+	to := func(pos int) func(int) int { return func(int) int { return pos } }
+
+	out, ok := reordered(ids, "9", to(1))
+	assert.True(t, ok)
+	assert.Equal(t, []uint64{9, 4, 7, 12}, out)
+
+	out, _ = reordered(ids, "4", to(10))
+	assert.Equal(t, []uint64{7, 9, 12, 4}, out)
+
+	out, _ = reordered(ids, "4", func(at int) int { return at - 1 })
+	assert.Equal(t, ids, out)
+
+	out, _ = reordered(ids, "7", func(at int) int { return at + 1 })
+	assert.Equal(t, []uint64{4, 9, 7, 12}, out)
+
+	_, ok = reordered(ids, "5", to(1))
+	assert.False(t, ok)
+}
+
+func TestOrderedScopeColumn(t *testing.T) {
+	type menu struct {
+		PKey
+		Ordered  `scope:"parent_id"`
+		ParentID *uint
+	}
+	assert.Equal(t, "parent_id", Ordered{}.ScopeColumn(&menu{}))
+	assert.Equal(t, "", Ordered{}.ScopeColumn(struct{ Ordered }{}))
+}
+
+func TestOrderedBehaviorHandle(t *testing.T) {
+	type playlist struct {
+		ID uint
+		Ordered
+	}
+
+	// the default is read upon the handle of the builder
+	dbo, f := newFakeDB(t)
+	f.on("SHOW TABLES", fakeReply{cols: []string{"table"}, rows: [][]driver.Value{{"t"}}})
+	f.on("SHOW COLUMNS", fakeReply{cols: []string{"Field", "Type", "Null", "Key", "Default", "Extra"}, rows: [][]driver.Value{{"sequence", "int", "NO", "", "0", ""}}})
+	stmts := behaviorStatements(mysqlSQL{}, dbo, &playlist{})
+	assert.Len(t, stmts, 1)
+	assert.Contains(t, stmts[0], "CREATE TRIGGER playlist_ordered_bfr_insert")
+	_, _, ok := f.find("SHOW COLUMNS FROM")
+	assert.True(t, ok)
+}
@@ -0,0 +1,249 @@
+package dorm
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Phases of a schema build, in the order in which
+// BuildSchema performs them
+const (
+	PhaseValidate       = "validate"
+	PhaseFunction       = "function"
+	PhaseAutoMigrate    = "automigrate"
+	PhaseHistory        = "history"
+	PhaseUniqueIndex    = "unique index"
+	PhaseIndex          = "index"
+	PhaseForeignKey     = "fk"
+	PhaseBehavior       = "behavior"
+	PhaseTrigger        = "trigger"
+	PhaseInitialRecords = "initial records"
+)
+
+// Step is a single statement that a schema build
+// executes (or would execute) against the database
+type Step struct {
+	Table string `json:"table"`
+	Phase string `json:"phase"`
+	SQL   string `json:"sql"`
+}
+
+// Plan is the ordered list of statements of a schema build
+type Plan []Step
+
+// String renders the plan as a reviewable sql script,
+// with every statement labelled by its phase and table
+func (p Plan) String() string {
+	var sb strings.Builder
+	for i, s := range p {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(fmt.Sprintf("-- %d. [%s] %s\n", i+1, s.Phase, s.Table))
+		sb.WriteString(strings.TrimSpace(s.SQL))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// PlanSchema works out every statement that BuildSchema
+// would run for the given models, without running any of them.
+// The database is only read from, to find out what already exists
+func PlanSchema(models ...interface{}) Plan {
+	plan, err := PlanSchemaE(models...)
+	if err != nil {
+		panic(err)
+	}
+	return plan
+}
+
+// PlanSchemaE is PlanSchema, returning a *SchemaError
+// instead of panicking when the plan cannot be worked out
+func PlanSchemaE(models ...interface{}) (plan Plan, err error) {
+	b := newSchemaBuilder(true)
+	defer b.catch(&err)
+	b.build(models...)
+	return b.plan, nil
+}
+
+// schemaBuilder carries the state of a single schema build.
+// In dry-run mode statements are only recorded in the plan,
+// and are never sent to the database
+type schemaBuilder struct {
+	dbo    *gorm.DB
+	sql    sqlDialect
+	dryRun bool
+	plan   Plan
+
+	// tables that the plan creates, but which
+	// do not exist yet (dry-run only)
+	planned map[string]bool
+
+	// checksums of generated objects, keyed by kind:name
+	versions map[string]string
+
+	// tables the generated objects were recorded
+	// against, keyed by kind:name
+	entities map[string]string
+
+	// table and phase being built, to which
+	// any failure is attributed
+	table string
+	phase string
+}
+
+func newSchemaBuilder(dryRun bool) *schemaBuilder {
+	dbo := db()
+	return &schemaBuilder{
+		dbo:      dbo,
+		sql:      dialectOf(dbo),
+		dryRun:   dryRun,
+		planned:  map[string]bool{},
+		versions: map[string]string{},
+		entities: map[string]string{},
+	}
+}
+
+// exec records the statement in the plan, and runs
+// it unless this is a dry-run
+func (b *schemaBuilder) exec(table string, phase string, sql string) {
+	b.plan = append(b.plan, Step{Table: table, Phase: phase, SQL: sql})
+	if b.dryRun {
+		return
+	}
+	err := b.dbo.Exec(sql).Error
+	if err != nil {
+		panic(&SchemaError{Table: table, Phase: phase, Statement: sql, Err: err})
+	}
+}
+
+// at notes the table and phase that the build is working upon
+func (b *schemaBuilder) at(model interface{}, phase string) {
+	b.table = Table(model)
+	b.phase = phase
+}
+
+// catch recovers from a failure of the build,
+// and returns it as a *SchemaError
+func (b *schemaBuilder) catch(err *error) {
+	if r := recover(); r != nil {
+		*err = asSchemaError(r, b.table, b.phase)
+	}
+}
+
+// hasTable tells if the table exists in the database. Tables that
+// only exist in the plan are reported as missing
+func (b *schemaBuilder) hasTable(table string) bool {
+	if b.planned[table] {
+		return false
+	}
+	return b.dbo.Dialect().HasTable(table)
+}
+
+// migrateSQL renders the statements that gorm's AutoMigrate
+// runs for the given model: a CREATE TABLE for a new table,
+// or an ALTER TABLE ... ADD for each missing column
+func (b *schemaBuilder) migrateSQL(model interface{}) []string {
+	scope := b.dbo.NewScope(model)
+	tbl := scope.TableName()
+	fields := scope.GetModelStruct().StructFields
+
+	if !b.hasTable(tbl) {
+		var cols []string
+		var keys []string
+		inlineKey := false
+		for _, field := range fields {
+			if field.IsNormal {
+				typ := scope.Dialect().DataTypeOf(field)
+				if strings.Contains(strings.ToLower(typ), "primary key") {
+					inlineKey = true
+				}
+				cols = append(cols, scope.Quote(field.DBName)+" "+typ)
+			}
+			if field.IsPrimaryKey {
+				keys = append(keys, scope.Quote(field.DBName))
+			}
+		}
+		pk := ""
+		if len(keys) > 0 && !inlineKey {
+			pk = fmt.Sprintf(", PRIMARY KEY (%v)", strings.Join(keys, ","))
+		}
+		b.planned[tbl] = true
+		return []string{fmt.Sprintf("CREATE TABLE %v (%v %v)", scope.QuotedTableName(), strings.Join(cols, ","), pk)}
+	}
+
+	out := []string{}
+	for _, field := range fields {
+		if field.IsNormal && !scope.Dialect().HasColumn(tbl, field.DBName) {
+			out = append(out, fmt.Sprintf("ALTER TABLE %v ADD %v %v;", scope.QuotedTableName(), scope.Quote(field.DBName), scope.Dialect().DataTypeOf(field)))
+		}
+	}
+	return out
+}
+
+// insertSQL renders the INSERT statement that gorm
+// would issue to create the given record
+func (b *schemaBuilder) insertSQL(row interface{}) string {
+	scope := b.dbo.NewScope(row)
+	var cols, vals []string
+	for _, f := range scope.Fields() {
+		if !f.IsNormal || f.IsIgnored {
+			continue
+		}
+		if f.IsBlank && (f.IsPrimaryKey || f.HasDefaultValue) {
+			continue
+		}
+		cols = append(cols, scope.Quote(f.DBName))
+		vals = append(vals, sqlLiteral(f.Field.Interface()))
+	}
+	return fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v)", scope.QuotedTableName(), strings.Join(cols, ","), strings.Join(vals, ","))
+}
+
+// sqlLiteral formats a go value as an sql literal. It is meant
+// for display, and for values that dorm generates itself (names
+// and checksums). It must never be used for user input
+func sqlLiteral(val interface{}) string {
+	if v, ok := val.(driver.Valuer); ok {
+		rv := reflect.ValueOf(val)
+		if rv.Kind() == reflect.Ptr && rv.IsNil() {
+			return "NULL"
+		}
+		dv, err := v.Value()
+		if err != nil {
+			return "NULL"
+		}
+		val = dv
+	}
+
+	rv := reflect.ValueOf(val)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return "NULL"
+		}
+		rv = rv.Elem()
+		val = rv.Interface()
+	}
+
+	switch it := val.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.Replace(it, "'", "''", -1) + "'"
+	case []byte:
+		return "'" + strings.Replace(string(it), "'", "''", -1) + "'"
+	case time.Time:
+		return "'" + it.Format("2006-01-02 15:04:05.999999") + "'"
+	case bool:
+		if it {
+			return "1"
+		}
+		return "0"
+	default:
+		return fmt.Sprint(it)
+	}
+}
@@ -0,0 +1,98 @@
+package dorm
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanString(t *testing.T) {
+	p := Plan{
+		{Table: "product", Phase: PhaseAutoMigrate, SQL: "CREATE TABLE `product` (`id` int)"},
+		{Table: "product", Phase: PhaseIndex, SQL: " CREATE INDEX idx_name ON `product`(`name`) "},
+	}
+
+	assert.Equal(t, "-- 1. [automigrate] product\nCREATE TABLE `product` (`id` int)\n\n-- 2. [index] product\nCREATE INDEX idx_name ON `product`(`name`)\n", p.String())
+	assert.Equal(t, "", Plan{}.String())
+}
+
+func TestSqlLiteral(t *testing.T) {
+	str := "it's"
+	var nilStr *string
+	var nilDoc *JDoc
+
+	assert.Equal(t, "'it''s'", sqlLiteral(str))
+	assert.Equal(t, "'it''s'", sqlLiteral(&str))
+	assert.Equal(t, "NULL", sqlLiteral(nilStr))
+	assert.Equal(t, "NULL", sqlLiteral(nilDoc))
+	assert.Equal(t, "NULL", sqlLiteral(nil))
+	assert.Equal(t, "12", sqlLiteral(uint(12)))
+	assert.Equal(t, "1", sqlLiteral(true))
+	assert.Equal(t, `'{"a":1}'`, sqlLiteral(NewJDoc().Set("a", 1)))
+	assert.Equal(t, "'2019-03-18 10:20:30'", sqlLiteral(time.Date(2019, 3, 18, 10, 20, 30, 0, time.UTC)))
+}
+
+type shade struct {
+	PKey
+	Code string `sql:"TYPE:varchar(16)" json:"code" unique:"true"`
+	Name string `sql:"TYPE:varchar(64)" json:"name"`
+}
+
+func (shade) InitialRecords() []interface{} {
+	return []interface{}{
+		&shade{PKey: PKey{ID: 1}, Code: "red", Name: "Red"},
+		&shade{Code: "blue", Name: "Blue"},
+	}
+}
+
+func TestRecordKey(t *testing.T) {
+	dbo, _ := newFakeDB(t)
+	b := &schemaBuilder{dbo: dbo, sql: mysqlSQL{}}
+
+	key, where, args, ok := b.recordKey(&shade{PKey: PKey{ID: 1}, Code: "red"})
+	assert.True(t, ok)
+	assert.Equal(t, "id=1", key)
+	assert.Equal(t, "`id` = ?", where)
+	assert.Equal(t, []interface{}{uint(1)}, args)
+
+	key, where, _, ok = b.recordKey(&shade{Code: "blue"})
+	assert.True(t, ok)
+	assert.Equal(t, "code=blue", key)
+	assert.Equal(t, "`code` = ?", where)
+
+	_, _, _, ok = b.recordKey(&shade{Name: "Blue"})
+	assert.False(t, ok)
+}
+
+func TestInsertInitialRecords(t *testing.T) {
+	dbo, f := newFakeDB(t)
+	f.on("SHOW TABLES", fakeReply{cols: []string{"table"}, rows: [][]driver.Value{{"shade"}}})
+	f.on("WHERE `id` = ?", fakeReply{cols: []string{"count"}, rows: [][]driver.Value{{int64(1)}}})
+	f.on("WHERE `code` = ?", fakeReply{cols: []string{"count"}, rows: [][]driver.Value{{int64(0)}}})
+
+	// the edited record of id 1 is updated, rather than inserted again,
+	// and the record of blue (whose row is missing) is inserted
+	b := &schemaBuilder{dbo: dbo, sql: mysqlSQL{}, planned: map[string]bool{}, versions: map[string]string{
+		ObjectRecord + ":shade:id=1": "stale",
+	}, entities: map[string]string{}}
+	b.insertInitialRecords(&shade{})
+
+	_, _, ok := f.find("UPDATE `shade` SET")
+	assert.True(t, ok)
+	stmt, _, ok := f.find("INSERT INTO `shade`")
+	assert.True(t, ok)
+	assert.NotContains(t, stmt, "`id`")
+
+	sum := b.versions[ObjectRecord+":shade:id=1"]
+	assert.Equal(t, checksum(b.insertSQL(&shade{PKey: PKey{ID: 1}, Code: "red", Name: "Red"})), sum)
+	assert.NotEmpty(t, b.versions[ObjectRecord+":shade:code=blue"])
+
+	// records that are current are skipped
+	dbo, f = newFakeDB(t)
+	b.dbo = dbo
+	b.insertInitialRecords(&shade{})
+	_, _, ok = f.find("shade")
+	assert.False(t, ok)
+}
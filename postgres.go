@@ -0,0 +1,677 @@
+package dorm
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/fig"
+)
+
+// behaviours of models on postgres. Triggers on postgres
+// execute a function, which is created (or replaced) by
+// the same statement that creates the trigger
+var behavePostgres = map[interface{}][]string{}
+
+var behaveModelPostgres = map[interface{}]dynamicBehavior{}
+
+func init() {
+	initPostgresDialect()
+	initPostgresBehaviors()
+}
+
+// pgTrigger returns the statement that creates the trigger
+// (and its function) with the given plpgsql body
+func pgTrigger(name string, when string, body string) string {
+	return fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s() RETURNS trigger AS $$
+		%s
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER %s %s ON <<Table>> FOR EACH ROW EXECUTE PROCEDURE %s();`, name, body, name, when, name)
+}
+
+func pgUID(size int) []string {
+	name := fmt.Sprintf("<<Table>>_uid%d_bfr_insert", size)
+	return []string{pgTrigger(name, "BEFORE INSERT", fmt.Sprintf(`BEGIN
+			IF NEW.uid IS NULL OR NEW.uid = '' THEN
+				LOOP
+					NEW.uid := randstr(%d);
+					EXIT WHEN NOT EXISTS (SELECT 1 FROM <<Table>> WHERE uid = NEW.uid);
+				END LOOP;
+			END IF;
+			RETURN NEW;
+		END`, size))}
+}
+
+// pgStateful validates the machine_state against the state
+// machine of the table (and machine_kind, when kinded), and
+// logs every change of state into state_log
+func pgStateful(name string, kinded bool, noState string) []string {
+	where := "entity = '<<Table>>'"
+	checkKind := ""
+	if kinded {
+		where += " AND kind = NEW.machine_kind"
+		checkKind = `
+			IF TG_OP = 'INSERT' THEN
+				IF NEW.machine_kind IS NULL OR NEW.machine_kind = '' THEN
+					RAISE EXCEPTION 'State machine kind is missing during row insertion';
+				END IF;
+			ELSIF OLD.machine_kind <> NEW.machine_kind THEN
+				RAISE EXCEPTION 'cannot update machine_kind';
+			END IF;`
+	}
+
+	return []string{
+		pgTrigger("<<Table>>_"+name+"_bfr", "BEFORE INSERT OR UPDATE", fmt.Sprintf(`DECLARE
+			fnd  INT;
+			deft VARCHAR(128);
+			entr JSONB;
+			sts  JSONB;
+			trns JSONB;
+			st   JSONB;
+		BEGIN%s
+
+			SELECT count(1) INTO fnd FROM state_machine WHERE %s;
+			SELECT default_state, entry_states::jsonb, states::jsonb, transitions::jsonb INTO deft, entr, sts, trns FROM state_machine WHERE %s LIMIT 1;
+			st := jsonb_build_array(NEW.machine_state::text);
+
+			IF TG_OP = 'INSERT' THEN
+				IF NEW.machine_state IS NOT NULL THEN
+					IF fnd = 0 THEN
+						RAISE EXCEPTION 'State machine definition is missing';
+					ELSIF entr IS NOT NULL AND NOT entr @> st THEN
+						RAISE EXCEPTION 'Invalid machine_state, should be one of entry_states';
+					ELSIF NOT sts @> st THEN
+						RAISE EXCEPTION 'Invalid machine_state, should be one of states';
+					END IF;
+				ELSIF fnd = 1 THEN
+					NEW.machine_state := deft;
+				END IF;
+				IF NEW.machine_state IS NOT NULL THEN
+					NEW.stated_at := NOW();
+				END IF;
+				RETURN NEW;
+			END IF;
+
+			-- remove stale remarks
+			IF NEW.state_remarks IS NULL OR NEW.state_remarks = '' OR NEW.state_remarks = OLD.state_remarks THEN
+				NEW.state_remarks := NULL;
+			END IF;
+
+			IF NEW.machine_state IS NOT NULL THEN
+				IF fnd = 0 THEN
+					RAISE EXCEPTION 'State machine definition is missing';
+				ELSIF sts IS NOT NULL AND NOT sts @> st THEN
+					RAISE EXCEPTION 'New state is not a valid state definition';
+				END IF;
+
+				IF OLD.machine_state IS NULL THEN
+					IF entr IS NOT NULL AND NOT entr @> st THEN
+						RAISE EXCEPTION 'UPDATE must assign an entry state, as old state is NULL';
+					END IF;
+					NEW.stated_at := NOW();
+				ELSIF OLD.machine_state <> NEW.machine_state THEN
+					IF trns IS NOT NULL AND NOT trns @> jsonb_build_array(jsonb_build_object('from', OLD.machine_state, 'to', NEW.machine_state)) THEN
+						RAISE EXCEPTION 'No transition available from old state to new one';
+					END IF;
+					NEW.stated_at := NOW();
+				END IF;
+			ELSIF OLD.machine_state IS NOT NULL THEN
+				RAISE EXCEPTION 'UPDATE cannot set machine_state to NULL';
+			END IF;
+
+			RETURN NEW;
+		END`, checkKind, where, where)),
+
+		// push changes of state to state_log
+		pgTrigger("<<Table>>_"+name+"_aft", "AFTER INSERT OR UPDATE", fmt.Sprintf(`DECLARE
+			r VARCHAR(256);
+		BEGIN
+			IF TG_OP = 'INSERT' THEN
+				r := NEW.state_remarks;
+				IF NEW.machine_state IS NOT NULL THEN
+					INSERT INTO state_log (entity,entity_id,created_at,updated_at,old_state,new_state,remarks,who) VALUES ('<<Table>>',NEW.id,NEW.created_at,NEW.updated_at,%s,NEW.machine_state,r,NEW.who);
+				END IF;
+				RETURN NULL;
+			END IF;
+
+			IF NEW.state_remarks IS NOT NULL AND (OLD.state_remarks IS NULL OR OLD.state_remarks <> NEW.state_remarks) THEN
+				r := NEW.state_remarks;
+			END IF;
+			IF OLD.machine_state IS NULL AND NEW.machine_state IS NOT NULL THEN
+				INSERT INTO state_log (entity,entity_id,created_at,updated_at,old_state,new_state,remarks,who) VALUES ('<<Table>>',NEW.id,NEW.created_at,NEW.updated_at,%s,NEW.machine_state,r,NEW.who);
+			ELSIF OLD.machine_state IS NOT NULL AND NEW.machine_state IS NOT NULL AND OLD.machine_state <> NEW.machine_state THEN
+				INSERT INTO state_log (entity,entity_id,created_at,updated_at,old_state,new_state,remarks,who) VALUES ('<<Table>>',NEW.id,NEW.created_at,NEW.updated_at,OLD.machine_state,NEW.machine_state,r,NEW.who);
+			END IF;
+			RETURN NULL;
+		END`, noState, noState)),
+	}
+}
+
+func initPostgresBehaviors() {
+
+	// UID
+	behavePostgres[UID32{}] = pgUID(32)
+	behavePostgres[UID24{}] = pgUID(24)
+	behavePostgres[UID16{}] = pgUID(16)
+	behavePostgres[UID10{}] = pgUID(10)
+	behavePostgres[UID8{}] = pgUID(8)
+
+	// SoftDelete
+	softDelete := []string{
+		pgTrigger("<<Table>>_softdelete_bfr", "BEFORE UPDATE OR DELETE", `BEGIN
+			IF TG_OP = 'DELETE' THEN
+				-- unless purging (see PurgeDeleted)
+				IF COALESCE(current_setting('dorm.purge', true), '') = 'on' THEN
+					RETURN OLD;
+				END IF;
+				RAISE EXCEPTION 'Cannot delete records from table. Instead set deleted=1';
+			END IF;
+			IF OLD.deleted = 0 AND NEW.deleted = 1 THEN
+				NEW.deleted_at := NOW();
+			END IF;
+			IF OLD.deleted = 1 AND NEW.deleted = 0 THEN
+				NEW.deleted_at := NULL;
+			END IF;
+			RETURN NEW;
+		END`),
+	}
+	behavePostgres[SoftDelete{}] = softDelete
+	behavePostgres[SoftDelete4{}] = softDelete
+
+	// Tenanted
+	behavePostgres[Tenanted{}] = []string{
+		pgTrigger("<<Table>>_tenanted_bfr_update", "BEFORE UPDATE", `BEGIN
+			IF NEW.tenant_id <> OLD.tenant_id THEN
+				RAISE EXCEPTION 'tenant_id cannot be updated';
+			END IF;
+			RETURN NEW;
+		END`),
+	}
+
+	// Versioned
+	behavePostgres[Versioned{}] = []string{
+		pgTrigger("<<Table>>_versioned_bfr_update", "BEFORE UPDATE", `BEGIN
+			-- unless rotating keys (see RotateKeys)
+			IF COALESCE(current_setting('dorm.rotate', true), '') <> 'on' THEN
+				NEW.version := OLD.version + 1;
+			END IF;
+			RETURN NEW;
+		END`),
+	}
+
+	// Stateful (timestamps carry microseconds on postgres,
+	// so the "4" variants are alike the others)
+	behavePostgres[Stateful{}] = pgStateful("stateful", false, "''")
+	behavePostgres[StatefulKind{}] = pgStateful("stateful_kind", true, "NULL")
+	behavePostgres[Stateful4{}] = pgStateful("stateful_4", false, "NULL")
+	behavePostgres[StatefulKind4{}] = pgStateful("stateful_kind_4", true, "NULL")
+
+	// Timed: postgres has no "on update current_timestamp"
+	timed := []string{
+		pgTrigger("<<Table>>_timed_bfr_update", "BEFORE UPDATE", `BEGIN
+			-- unless rotating keys (see RotateKeys)
+			IF COALESCE(current_setting('dorm.rotate', true), '') <> 'on' THEN
+				NEW.updated_at := NOW();
+			END IF;
+			RETURN NEW;
+		END`),
+	}
+	behavePostgres[Timed{}] = timed
+	behavePostgres[TimedLite{}] = timed
+	behavePostgres[Timed4{}] = timed
+	behavePostgres[Timed4Lite{}] = timed
+
+	// Ordered
+	behaveModelPostgres[Ordered{}] = func(dbo *gorm.DB, model interface{}) []string {
+		where := ""
+		if scope := (Ordered{}).ScopeColumn(model); scope != "" {
+			where = fmt.Sprintf(" WHERE %s IS NOT DISTINCT FROM NEW.%s", pgQuote(scope), pgQuote(scope))
+		}
+		cols := func(tbl string) ([]showColumn, error) {
+			return postgresSQL{}.columns(dbo, tbl)
+		}
+		return append(orderedDefault(dbo, model, cols, "ALTER TABLE <<Table>> ALTER COLUMN sequence SET DEFAULT 0"),
+			pgTrigger("<<Table>>_ordered_bfr_insert", "BEFORE INSERT", fmt.Sprintf(`BEGIN
+			IF NEW.sequence IS NULL OR NEW.sequence = 0 THEN
+				NEW.sequence := (SELECT COALESCE(MAX(sequence), 0) + 1 FROM <<Table>>%s);
+			END IF;
+			RETURN NEW;
+		END`, where)))
+	}
+
+	// SEO
+	behaveModelPostgres[SeoField{}] = func(dbo *gorm.DB, model interface{}) []string {
+		s := SeoField{}
+
+		urlRefModel, colToQuery, colToFetch := s.GetURLRef(model)
+		urlColumn := s.UrlColumn(model)
+
+		fetch := fmt.Sprintf("SELECT %s INTO tmp FROM %s WHERE %s = NEW.%s LIMIT 1;", colToFetch, urlRefModel, colToQuery, urlColumn)
+		if urlRefModel == "DUAL" {
+			fetch = fmt.Sprintf("tmp := NEW.%s;", urlColumn)
+		}
+
+		return []string{
+			pgTrigger("<<Table>>_seo_bfr", "BEFORE INSERT OR UPDATE", fmt.Sprintf(`DECLARE
+				tmp VARCHAR(256);
+				cnt INT := 0;
+				arr JSONB;
+			BEGIN
+				IF TG_OP = 'INSERT' THEN
+					IF NEW.url = '' THEN
+						%s
+						NEW.url := '%s/' || geturl(tmp);
+					END IF;
+					IF LEFT(NEW.url, 1) <> '/' THEN
+						NEW.url := '/' || NEW.url;
+					END IF;
+					IF EXISTS (SELECT 1 FROM <<Table>> WHERE url = NEW.url) THEN
+						LOOP
+							cnt := cnt + 1;
+							EXIT WHEN NOT EXISTS (SELECT 1 FROM <<Table>> WHERE url = NEW.url || '-' || cnt);
+						END LOOP;
+						NEW.url := NEW.url || '-' || cnt;
+					END IF;
+					RETURN NEW;
+				END IF;
+
+				IF NEW.seo IS NOT NULL THEN
+					NEW.seo := jsonb_set(NEW.seo, '{url_past}', COALESCE(OLD.seo -> 'url_past', '[]'::jsonb));
+				END IF;
+
+				IF NEW.url = '' THEN
+					RAISE EXCEPTION 'URL cannot be updated to EMPTY';
+				END IF;
+
+				IF LEFT(NEW.url, 1) <> '/' THEN
+					NEW.url := '/' || NEW.url;
+				END IF;
+
+				IF OLD.url <> '' AND NEW.url <> OLD.url THEN
+					NEW.seo := COALESCE(NEW.seo, '{}'::jsonb);
+					arr := COALESCE(NEW.seo -> 'url_past', '[]'::jsonb);
+					IF NOT arr @> jsonb_build_array(OLD.url) THEN
+						arr := arr || jsonb_build_array(OLD.url);
+					END IF;
+					NEW.seo := jsonb_set(NEW.seo, '{url_past}', arr);
+				END IF;
+				RETURN NEW;
+			END`, fetch, s.UrlPrefix(model))),
+		}
+	}
+}
+
+// postgresFunctions are the stored functions that
+// behaviors depend upon, on postgres
+var postgresFunctions = []sqlFunction{
+	// function: url cleanup
+	{"geturl", `CREATE OR REPLACE FUNCTION geturl(str VARCHAR) RETURNS VARCHAR AS $$
+		SELECT LEFT(regexp_replace(translate(regexp_replace(lower(trim(str)), '[^[:alnum:] _-]', '', 'g'), ' ', '-'), '-{2,}', '-', 'g'), 256)
+	$$ LANGUAGE sql IMMUTABLE`},
+
+	// function: random string generator
+	{"randstr", `CREATE OR REPLACE FUNCTION randstr(n INT) RETURNS VARCHAR AS $$
+		SELECT string_agg(substr('ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789', floor(random() * 62)::int + 1, 1), '')
+		FROM generate_series(1, n)
+	$$ LANGUAGE sql VOLATILE`},
+}
+
+type postgresSQL struct{}
+
+func (postgresSQL) behaviors() (map[interface{}][]string, map[interface{}]dynamicBehavior) {
+	return behavePostgres, behaveModelPostgres
+}
+
+func (postgresSQL) functions() []sqlFunction {
+	return postgresFunctions
+}
+
+func (postgresSQL) hasTrigger(dbo *gorm.DB, name string) bool {
+	var count int
+	dbo.Raw("SELECT count(*) FROM information_schema.triggers WHERE trigger_schema = current_schema() AND trigger_name = ?", name).Row().Scan(&count)
+	return count > 0
+}
+
+func (postgresSQL) hasFunction(dbo *gorm.DB, name string) bool {
+	var count int
+	dbo.Raw("SELECT count(*) FROM information_schema.routines WHERE routine_schema = current_schema() AND routine_type = 'FUNCTION' AND routine_name = ?", name).Row().Scan(&count)
+	return count > 0
+}
+
+// postgres trigger names are unique within the table. The
+// function that the trigger executes is dropped along with it
+func (postgresSQL) dropTrigger(name string, table string) string {
+	return "DROP TRIGGER IF EXISTS " + name + " ON " + pgQuote(table) + "; DROP FUNCTION IF EXISTS " + name + "()"
+}
+
+func (postgresSQL) dropFunction(name string) string {
+	return "DROP FUNCTION IF EXISTS " + name
+}
+
+func (postgresSQL) upsert(table string, cols []string, vals []string, keys []string, update []string) string {
+	set := make([]string, len(update))
+	for i, c := range update {
+		set[i] = c + " = EXCLUDED." + c
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s", table, strings.Join(cols, ", "), strings.Join(vals, ", "), strings.Join(keys, ", "), strings.Join(set, ", "))
+}
+
+func (postgresSQL) columns(dbo *gorm.DB, table string) ([]showColumn, error) {
+	var flds []showColumn
+	err := dbo.Raw(`SELECT a.attname AS "Field", format_type(a.atttypid, a.atttypmod) AS "Type",
+			CASE WHEN a.attnotnull THEN 'NO' ELSE 'YES' END AS "Null", '' AS "Key",
+			pg_get_expr(d.adbin, d.adrelid) AS "Default", '' AS "Extra"
+		FROM pg_attribute a
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attrelid = to_regclass(?) AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum`, table).Find(&flds).Error
+	return flds, err
+}
+
+// createHistory creates the history table alike the base table
+// (LIKE copies neither defaults nor keys), with row_id, action
+// and actioned_at after the copied columns
+func (postgresSQL) createHistory(tbl string, hist string, cols []showColumn) []string {
+	return []string{
+		fmt.Sprintf("CREATE TABLE %s (LIKE %s)", pgQuote(hist), pgQuote(tbl)),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN row_id BIGSERIAL PRIMARY KEY, ADD COLUMN action VARCHAR(6) NOT NULL DEFAULT 'insert', ADD COLUMN actioned_at TIMESTAMP NOT NULL DEFAULT NOW()", pgQuote(hist)),
+	}
+}
+
+// createArchive copies the indexes, and so the primary key on
+// row_id, but not the defaults, which draw on the sequence of
+// the history table
+func (postgresSQL) createArchive(arch string, hist string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (LIKE %s INCLUDING INDEXES)", pgQuote(arch), pgQuote(hist))
+}
+
+func (postgresSQL) addArchiveColumn(arch string, c showColumn) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", pgQuote(arch), pgQuote(c.Name), c.Type)
+}
+
+func (postgresSQL) archiveRows(arch string, hist string, cols []string) string {
+	list := make([]string, len(cols))
+	for i, c := range cols {
+		list[i] = pgQuote(c)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s WHERE row_id IN (?) ON CONFLICT (row_id) DO NOTHING", pgQuote(arch), strings.Join(list, ", "), strings.Join(list, ", "), pgQuote(hist))
+}
+
+// syncHistory adds the missing columns to the history table, and
+// changes the type of the others to match the base table. Postgres
+// cannot reorder columns, which the audit trigger lists by name.
+// Columns since dropped from the base table are made nullable
+func (postgresSQL) syncHistory(hist string, cols []showColumn, have []showColumn) []string {
+	current := map[string]showColumn{}
+	for _, c := range have {
+		current[c.Name] = c
+	}
+
+	base := map[string]bool{}
+	for _, c := range historyColumns {
+		base[c] = true
+	}
+
+	clauses := []string{}
+	for _, c := range cols {
+		base[c.Name] = true
+		h, ok := current[c.Name]
+		switch {
+		case !ok:
+			clauses = append(clauses, fmt.Sprintf("ADD COLUMN %s %s", pgQuote(c.Name), c.Type))
+		case h.Type != c.Type:
+			clauses = append(clauses, fmt.Sprintf("ALTER COLUMN %s TYPE %s USING %s::%s", pgQuote(c.Name), c.Type, pgQuote(c.Name), c.Type))
+		}
+	}
+	for _, c := range have {
+		if !base[c.Name] && c.Null == "NO" {
+			clauses = append(clauses, fmt.Sprintf("ALTER COLUMN %s DROP NOT NULL", pgQuote(c.Name)))
+		}
+	}
+
+	if len(clauses) == 0 {
+		return nil
+	}
+	return []string{"ALTER TABLE " + pgQuote(hist) + " " + strings.Join(clauses, ", ")}
+}
+
+// auditTriggers returns the trigger on the base table
+// that copies every change into its history table
+func (postgresSQL) auditTriggers(tbl string, cols []string) []string {
+	names := []string{"action", "actioned_at"}
+	news := []string{}
+	olds := []string{}
+	for _, c := range cols {
+		names = append(names, pgQuote(c))
+		news = append(news, "NEW."+pgQuote(c))
+		olds = append(olds, "OLD."+pgQuote(c))
+	}
+
+	trig := pgTrigger("<<Table>>_audit_trail", "AFTER INSERT OR UPDATE OR DELETE", fmt.Sprintf(`BEGIN
+			-- unless rotating keys (see RotateKeys)
+			IF TG_OP = 'UPDATE' AND COALESCE(current_setting('dorm.rotate', true), '') = 'on' THEN
+				RETURN NULL;
+			END IF;
+			IF TG_OP = 'DELETE' THEN
+				INSERT INTO %s (%s) VALUES ('delete', NOW(), %s);
+			ELSE
+				INSERT INTO %s (%s) VALUES (lower(TG_OP), NOW(), %s);
+			END IF;
+			RETURN NULL;
+		END`, historyPrefix+tbl, strings.Join(names, ", "), strings.Join(olds, ", "),
+		historyPrefix+tbl, strings.Join(names, ", "), strings.Join(news, ", ")))
+
+	return []string{strings.Replace(trig, "<<Table>>", tbl, -1)}
+}
+
+// postgres index names are unique within the schema,
+// so they are qualified with the table name
+func (postgresSQL) indexName(tbl string, name string) string {
+	if strings.Contains(name, tbl) {
+		return name
+	}
+	return tbl + "_" + name
+}
+
+// liveIndexes returns the indexes of the table, by name only
+func (postgresSQL) liveIndexes(dbo *gorm.DB, tbl string) (map[string]indexDef, []string) {
+	var names []string
+	err := dbo.Raw("SELECT indexname FROM pg_indexes WHERE schemaname = current_schema() AND tablename = ? ORDER BY indexname", tbl).Pluck("indexname", &names).Error
+	if err != nil {
+		panic(err)
+	}
+	live := map[string]indexDef{}
+	for _, n := range names {
+		live[n] = indexDef{Name: n}
+	}
+	return live, names
+}
+
+// createIndex renders the index for postgres. Fulltext indexes
+// are built with gin upon the text search vector of the columns,
+// and spatial ones with gist. Prefix lengths are not supported by
+// postgres, and are left out
+func (postgresSQL) createIndex(tbl string, idx indexDef) string {
+	parts := make([]string, len(idx.Parts))
+	for i, p := range idx.Parts {
+		p.Length = 0
+		parts[i] = p.sql(pgQuote)
+	}
+
+	switch idx.Type {
+	case IndexFulltext:
+		for i := range parts {
+			parts[i] = "coalesce(" + parts[i] + ", '')"
+		}
+		return fmt.Sprintf("CREATE INDEX %s ON %s USING gin (to_tsvector('simple', %s))", idx.Name, pgQuote(tbl), strings.Join(parts, " || ' ' || "))
+	case IndexSpatial:
+		return fmt.Sprintf("CREATE INDEX %s ON %s USING gist (%s)", idx.Name, pgQuote(tbl), strings.Join(parts, ", "))
+	}
+	return idx.create(pgQuote, tbl)
+}
+
+func (postgresSQL) dropIndex(tbl string, name string) string {
+	return "DROP INDEX " + name
+}
+
+// liveForeignKeys returns the foreign keys of the table, by name only
+func (postgresSQL) liveForeignKeys(dbo *gorm.DB, tbl string) (map[string]foreignKeyDef, []string) {
+	var names []string
+	err := dbo.Raw("SELECT conname FROM pg_constraint WHERE conrelid = to_regclass(?) AND contype = 'f' ORDER BY conname", tbl).Pluck("conname", &names).Error
+	if err != nil {
+		panic(err)
+	}
+	live := map[string]foreignKeyDef{}
+	for _, n := range names {
+		live[n] = foreignKeyDef{Name: n}
+	}
+	return live, names
+}
+
+func (postgresSQL) referencedBy(dbo *gorm.DB, tbl string) []string {
+	var tables []string
+	err := dbo.Raw("SELECT DISTINCT conrelid::regclass::text AS tbl FROM pg_constraint WHERE confrelid = to_regclass(?) AND contype = 'f' ORDER BY tbl", tbl).Pluck("tbl", &tables).Error
+	if err != nil {
+		panic(err)
+	}
+	return tables
+}
+
+func (postgresSQL) dropForeignKey(tbl string, name string) string {
+	return fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", pgQuote(tbl), pgQuote(name))
+}
+
+// softCascade restores the rows that were deleted along with
+// the referenced row, but not those deleted ahead of it
+func (postgresSQL) softCascade(tbl string, fk foreignKeyDef) string {
+	match := make([]string, len(fk.Columns))
+	for i := range fk.Columns {
+		match[i] = fmt.Sprintf("%s = NEW.%s", pgQuote(fk.Columns[i]), pgQuote(fk.RefColumns[i]))
+	}
+	where := strings.Join(match, " AND ")
+
+	trig := pgTrigger(softCascadeName(tbl, fk), "AFTER UPDATE", fmt.Sprintf(`BEGIN
+			IF OLD.deleted = 0 AND NEW.deleted = 1 THEN
+				UPDATE %s SET deleted = 1 WHERE %s AND deleted = 0;
+			ELSIF OLD.deleted = 1 AND NEW.deleted = 0 THEN
+				UPDATE %s SET deleted = 0 WHERE %s AND deleted = 1 AND deleted_at >= OLD.deleted_at - INTERVAL '1 second';
+			END IF;
+			RETURN NULL;
+		END`, pgQuote(tbl), where, pgQuote(tbl), where))
+	return strings.Replace(trig, "<<Table>>", pgQuote(fk.RefTable), -1)
+}
+
+func (postgresSQL) purge(allow bool) string {
+	if allow {
+		return "SET LOCAL dorm.purge = 'on'"
+	}
+	return "SET LOCAL dorm.purge = 'off'"
+}
+
+func (postgresSQL) rotate(on bool) string {
+	if on {
+		return "SET LOCAL dorm.rotate = 'on'"
+	}
+	return "SET LOCAL dorm.rotate = 'off'"
+}
+
+func (postgresSQL) lastInsertID() string {
+	return "SELECT lastval()"
+}
+
+func (postgresSQL) ago() string {
+	return "NOW() - ? * INTERVAL '1 second'"
+}
+
+func pgQuote(key string) string {
+	return `"` + key + `"`
+}
+
+// createPostgresDatabase creates the database (unless it exists)
+// from the server's default database, and the stored functions
+// within it
+func createPostgresDatabase(name string) error {
+	p := PgConn{}
+	fig.Struct(&p, "database.master")
+
+	exec := func(dbo *gorm.DB, phase string, sql string) error {
+		if e := dbo.Exec(sql).Error; e != nil {
+			return &SchemaError{Table: name, Phase: phase, Statement: sql, Err: e}
+		}
+		return nil
+	}
+
+	p.Db = "postgres"
+	server := GetORMCstr("postgres", p.CStr())
+
+	var count int
+	server.Raw("SELECT count(*) FROM pg_database WHERE datname = ?", name).Row().Scan(&count)
+	if count == 0 {
+		if err := exec(server, PhaseCreateDatabase, "CREATE DATABASE "+pgQuote(name)+" ENCODING 'UTF8'"); err != nil {
+			return err
+		}
+	}
+
+	p.Db = name
+	dbo := GetORMCstr("postgres", p.CStr())
+	for _, fn := range postgresFunctions {
+		if err := exec(dbo, PhaseFunction, fn.sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postgresDialect is gorm's postgres dialect, with the mysql
+// column types used by the models (and their tags) translated
+// to those of postgres. Json columns are created as jsonb
+type postgresDialect struct {
+	gorm.Dialect
+}
+
+// gorm's own postgres dialect, wrapped by postgresDialect
+var postgresBase gorm.Dialect
+
+func initPostgresDialect() {
+	if d, ok := gorm.GetDialect("postgres"); ok {
+		postgresBase = d
+		gorm.RegisterDialect("postgres", &postgresDialect{})
+	}
+}
+
+// SetDB is called upon a new instance of the dialect,
+// for each connection opened with gorm
+func (p *postgresDialect) SetDB(db gorm.SQLCommon) {
+	p.Dialect = reflect.New(reflect.TypeOf(postgresBase).Elem()).Interface().(gorm.Dialect)
+	p.Dialect.SetDB(db)
+}
+
+func (p *postgresDialect) DataTypeOf(field *gorm.StructField) string {
+	return pgType(p.Dialect.DataTypeOf(field))
+}
+
+var pgTypes = []struct {
+	from *regexp.Regexp
+	to   string
+}{
+	{regexp.MustCompile(`(?i)\bjson\b`), "jsonb"},
+	{regexp.MustCompile(`(?i)\bdatetime\b`), "timestamp"},
+	{regexp.MustCompile(`(?i)\btinyint\b(\(\d+\))?`), "smallint"},
+	{regexp.MustCompile(`(?i)\bmediumint\b(\(\d+\))?`), "integer"},
+	{regexp.MustCompile(`(?i)\b(smallint|int|integer|bigint)\(\d+\)`), "$1"},
+	{regexp.MustCompile(`(?i)\b(tiny|medium|long)text\b`), "text"},
+	{regexp.MustCompile(`(?i)\bdouble\b`), "double precision"},
+	{regexp.MustCompile(`(?i)\benum\([^)]*\)`), "varchar(64)"},
+	{regexp.MustCompile(`(?i)\s+(unsigned|binary)\b`), ""},
+}
+
+// pgType translates a mysql column type (with its
+// attributes) to the equivalent postgres type
+func pgType(typ string) string {
+	for _, t := range pgTypes {
+		typ = t.from.ReplaceAllString(typ, t.to)
+	}
+	return typ
+}
@@ -0,0 +1,67 @@
+package dorm
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPgType(t *testing.T) {
+	assert.Equal(t, "jsonb", pgType("json"))
+	assert.Equal(t, "timestamp NULL", pgType("datetime NULL"))
+	assert.Equal(t, "smallint", pgType("tinyint(1) unsigned"))
+	assert.Equal(t, "int NOT NULL", pgType("int(11) unsigned NOT NULL"))
+	assert.Equal(t, "bigint", pgType("bigint unsigned"))
+	assert.Equal(t, "text", pgType("mediumtext"))
+	assert.Equal(t, "varchar(64)", pgType("enum('a','b')"))
+	assert.Equal(t, "double precision", pgType("double"))
+	assert.Equal(t, "varchar(128)", pgType("varchar(128)"))
+}
+
+func TestPostgresIndexName(t *testing.T) {
+	pg := postgresSQL{}
+	assert.Equal(t, "product_idx_sku", pg.indexName("product", "idx_sku"))
+	assert.Equal(t, "idx_product_sku", pg.indexName("product", "idx_product_sku"))
+}
+
+func TestPostgresCreateIndex(t *testing.T) {
+	pg := postgresSQL{}
+	idx := indexDef{Name: "product_ft", Type: IndexFulltext, Parts: []indexPart{{Column: "name"}, {Column: "info"}}}
+	assert.Equal(t, `CREATE INDEX product_ft ON "product" USING gin (to_tsvector('simple', coalesce("name", '') || ' ' || coalesce("info", '')))`, pg.createIndex("product", idx))
+}
+
+func TestPostgresSyncHistory(t *testing.T) {
+	pg := postgresSQL{}
+	cols := []showColumn{{Name: "id", Type: "integer", Null: "NO"}, {Name: "name", Type: "character varying(64)"}}
+	have := []showColumn{{Name: "row_id", Type: "bigint", Null: "NO"}, {Name: "id", Type: "integer", Null: "NO"}, {Name: "old", Type: "text", Null: "NO"}}
+	assert.Equal(t, []string{`ALTER TABLE "zoom_product" ADD COLUMN "name" character varying(64), ALTER COLUMN "old" DROP NOT NULL`}, pg.syncHistory("zoom_product", cols, have))
+	assert.Nil(t, pg.syncHistory("zoom_product", cols[:1], have[:2]))
+}
+
+type pgNote struct {
+	PKey
+	Title string `sql:"TYPE:varchar(64)" json:"title"`
+	Versioned
+	Tenanted
+}
+
+func TestPostgresWrites(t *testing.T) {
+	dbo, f := newFakeDBOf(t, "postgres")
+	assert.Equal(t, "postgres", dbo.Dialect().GetName())
+	f.on("lastval()", fakeReply{cols: []string{"lastval"}, rows: [][]driver.Value{{int64(7)}}})
+	f.on(`SELECT * FROM "pg_note"`, fakeReply{cols: []string{"id", "title"}, rows: [][]driver.Value{{int64(7), "a"}}})
+	dbo = WithTenant(dbo, "acme")
+
+	assert.Nil(t, InsertSelect(dbo, &pgNote{}, "title", "a"))
+	stmt, _, _ := f.find("INSERT INTO")
+	assert.Contains(t, stmt, `INSERT INTO "pg_note" (`)
+	assert.Contains(t, stmt, `"tenant_id"`)
+	_, args, ok := f.find(`SELECT * FROM "pg_note" WHERE id=`)
+	assert.True(t, ok)
+	assert.Equal(t, []driver.Value{int64(7)}, args)
+
+	assert.Nil(t, Update(dbo, "id", 7, &pgNote{}, "title", "b", "version", 2))
+	stmt, _, _ = f.find("UPDATE")
+	assert.Equal(t, `UPDATE "pg_note" SET "title"=$1 WHERE "id" = $2 AND "version" = $3 AND "tenant_id" = $4`, stmt)
+}
@@ -10,7 +10,24 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// ToMap returns the rows of the query as maps. Values encrypted
+// by dorm are decrypted, but for those that can not be (which
+// are left as they are), as ToMap knows no model
 func ToMap(dbo *gorm.DB, sql string, params ...interface{}) ([]map[string]interface{}, error) {
+	return toMap(dbo, nil, sql, params...)
+}
+
+// ToMapOf is ToMap for the rows of the model, whose encrypted
+// columns fail the read when they can not be decrypted
+func ToMapOf(dbo *gorm.DB, model interface{}, sql string, params ...interface{}) ([]map[string]interface{}, error) {
+	cols := map[string]bool{}
+	for _, col := range cryptOf(model).columns {
+		cols[col] = true
+	}
+	return toMap(dbo, cols, sql, params...)
+}
+
+func toMap(dbo *gorm.DB, encrypted map[string]bool, sql string, params ...interface{}) ([]map[string]interface{}, error) {
 
 	var out []map[string]interface{}
 
@@ -32,7 +49,18 @@ func ToMap(dbo *gorm.DB, sql string, params ...interface{}) ([]map[string]interf
 		len, e1 := column.Length()
 		null, e2 := column.Nullable()
 		prec, scale, e3 := column.DecimalSize()
-		log.Debug(column.Name(), "DbTypeName", column.DatabaseTypeName(), "Length", len, "Nullable", null, "gotype", column.ScanType(), "DecimalPrecision", prec, "DecimalScale", scale, "e1", e1, "e2", e2, "e3", e3)
+		log.Debug().
+			Str("column", column.Name()).
+			Str("db_type", column.DatabaseTypeName()).
+			Int64("length", len).
+			Bool("nullable", null).
+			Str("go_type", column.ScanType().String()).
+			Int64("precision", prec).
+			Int64("scale", scale).
+			Bool("has_length", e1).
+			Bool("has_nullable", e2).
+			Bool("has_decimal", e3).
+			Msg("column type")
 	}
 
 	for rows.Next() {
@@ -65,6 +93,9 @@ func ToMap(dbo *gorm.DB, sql string, params ...interface{}) ([]map[string]interf
 		}
 
 		repurpose(columns, object)
+		if err = decryptMap(object, encrypted); err != nil {
+			return nil, err
+		}
 		out = append(out, object)
 	}
 
@@ -102,3 +133,32 @@ func repurpose(cols []*sql.ColumnType, data map[string]interface{}) {
 
 	}
 }
+
+// decryptMap decrypts the values that were encrypted by dorm,
+// in place. Failures are returned for the encrypted columns
+// given, and leave the values of other columns as they are
+func decryptMap(data map[string]interface{}, encrypted map[string]bool) error {
+	for key, val := range data {
+		var str string
+		switch it := val.(type) {
+		case string:
+			str = it
+		case *sql.RawBytes:
+			str = string(*it)
+		default:
+			continue
+		}
+		if _, ok := keyVersionOf(str); !ok {
+			continue
+		}
+		plain, err := decryptValue(Keys, str)
+		if err != nil {
+			if encrypted[key] {
+				return fmt.Errorf("decrypt %s: %w", key, err)
+			}
+			continue
+		}
+		data[key] = plain
+	}
+	return nil
+}
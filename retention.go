@@ -0,0 +1,329 @@
+package dorm
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/fig"
+	"github.com/rs/zerolog/log"
+)
+
+// Archive destinations of pruned history rows, beside a
+// directory (for compressed json-lines files)
+const (
+	ArchiveNone  = ""
+	ArchiveTable = "table"
+)
+
+// Retention tells which rows of a history table are pruned.
+// Rows older than Days, and those beyond the latest Versions of
+// each id, are removed (zero keeps them). The latest version of
+// each id before the cutoff is always kept, so that AsOf holds
+// for any instant after the cutoff. Pruned rows are archived
+// to a table (ArchiveTable), or to files in the given directory
+type Retention struct {
+	Days     int
+	Versions int
+	Archive  string
+	Batch    int
+}
+
+// RetentionOf returns the retention of the model's history. It is
+// declared with tags on the embedded Historic
+// Historic `retain_days:"90" retain_versions:"50" archive:"table"`
+// which may be overridden with config, per table:
+// database:
+//		history:
+//			days: default for all tables
+//			versions: default for all tables
+//			archive: default for all tables
+//			batch: defaults to 1000
+//			<table>:
+//				days, versions, archive, batch
+func RetentionOf(model interface{}) Retention {
+	tbl := Table(model)
+
+	tag := reflect.StructTag("")
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if f, ok := t.FieldByName("Historic"); ok && f.Anonymous {
+		tag = f.Tag
+	}
+
+	intOf := func(tagKey string, key string, def int) int {
+		if v, err := strconv.Atoi(tag.Get(tagKey)); err == nil {
+			def = v
+		} else {
+			def = fig.IntOr(def, "database.history", key)
+		}
+		return fig.IntOr(def, "database.history", tbl, key)
+	}
+
+	archive, ok := tag.Lookup("archive")
+	if !ok {
+		archive = fig.StringOr(ArchiveNone, "database.history.archive")
+	}
+
+	return Retention{
+		Days:     intOf("retain_days", "days", 0),
+		Versions: intOf("retain_versions", "versions", 0),
+		Archive:  fig.StringOr(archive, "database.history", tbl, "archive"),
+		Batch:    fig.IntOr(fig.IntOr(1000, "database.history.batch"), "database.history", tbl, "batch"),
+	}
+}
+
+// PruneHistory removes (and archives) the rows of the model's
+// history that are past its retention, and returns their count.
+// Rows are removed in batches, so that the history table is
+// never locked for long. Servers that prune at the same time
+// take turns. The age of rows is reckoned by the clock of the
+// database, which stamps actioned_at. Pruning ranks rows with
+// ROW_NUMBER(), and so needs mysql 8 or postgres, upon either
+// of which the archive table is kept
+func PruneHistory(dbo *gorm.DB, model interface{}) (int, error) {
+	if !isHistoric(model) {
+		return 0, ErrNotHistoric
+	}
+
+	hist := historyPrefix + Table(model)
+	ret := RetentionOf(model)
+	if ret.Batch <= 0 {
+		ret.Batch = 1000
+	}
+
+	count := 0
+	err := WithDBLock(dbo, "dorm:prune:"+hist, func() error {
+		p := &pruner{dbo: dbo, hist: hist, ret: ret}
+		defer p.close()
+
+		if ret.Days > 0 {
+			if err := p.prune("actioned_at < "+dialectOf(dbo).ago(), 1, ret.Days*24*60*60); err != nil {
+				return err
+			}
+		}
+		if ret.Versions > 0 {
+			if err := p.prune("1 = 1", ret.Versions); err != nil {
+				return err
+			}
+		}
+
+		count = p.count
+		return nil
+	})
+	if count > 0 {
+		log.Info().
+			Str("history", hist).
+			Int("rows", count).
+			Msg("history: pruned rows")
+	}
+	return count, err
+}
+
+// pruneIDsSQL selects (a batch of) the ids of the history that
+// have more than keep rows that match the condition
+func pruneIDsSQL(hist string, where string, keep int, after bool) string {
+	if after {
+		where += " AND id > ?"
+	}
+	return fmt.Sprintf("SELECT id FROM %s WHERE %s GROUP BY id HAVING COUNT(*) > %d ORDER BY id LIMIT ?", hist, where, keep)
+}
+
+// pruneSQL selects the rows of the given ids that match the
+// condition, leaving out the latest ones of each id
+func pruneSQL(hist string, where string, keep int) string {
+	return fmt.Sprintf("SELECT row_id FROM (SELECT row_id, ROW_NUMBER() OVER (PARTITION BY id ORDER BY row_id DESC) AS dorm_n FROM %s WHERE id IN (?) AND %s) v WHERE dorm_n > %d ORDER BY row_id", hist, where, keep)
+}
+
+// pruner removes rows of a history table, archiving
+// them beforehand when so configured
+type pruner struct {
+	dbo   *gorm.DB
+	hist  string
+	ret   Retention
+	count int
+
+	// file archive, opened upon the first batch
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+// table returns the quoted name of the history table
+func (p *pruner) table() string {
+	return p.dbo.Dialect().Quote(p.hist)
+}
+
+// prune removes the rows that match the condition, but for the
+// latest keep of each id. Ids are taken batch by batch, and only
+// the rows of a batch are ranked at a time
+func (p *pruner) prune(where string, keep int, params ...interface{}) error {
+	var last string
+	for {
+		query := pruneIDsSQL(p.table(), where, keep, last != "")
+		args := append([]interface{}{}, params...)
+		if last != "" {
+			args = append(args, last)
+		}
+		var ids []string
+		if err := p.dbo.Raw(query, append(args, p.ret.Batch)...).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		var rows []uint64
+		if err := p.dbo.Raw(pruneSQL(p.table(), where, keep), append([]interface{}{ids}, params...)...).Pluck("row_id", &rows).Error; err != nil {
+			return err
+		}
+		for len(rows) > 0 {
+			n := p.ret.Batch
+			if n > len(rows) {
+				n = len(rows)
+			}
+			if err := p.remove(rows[:n]); err != nil {
+				return err
+			}
+			rows = rows[n:]
+		}
+
+		if len(ids) < p.ret.Batch {
+			return nil
+		}
+		last = ids[len(ids)-1]
+	}
+}
+
+// remove archives, and then deletes, the rows
+func (p *pruner) remove(rows []uint64) error {
+	if err := p.archive(rows); err != nil {
+		return err
+	}
+	if err := p.dbo.Exec("DELETE FROM "+p.table()+" WHERE row_id IN (?)", rows).Error; err != nil {
+		return err
+	}
+	p.count += len(rows)
+	return nil
+}
+
+func (p *pruner) archive(ids []uint64) error {
+	switch p.ret.Archive {
+	case ArchiveNone:
+		return nil
+	case ArchiveTable:
+		return p.archiveTable(ids)
+	default:
+		return p.archiveFile(ids)
+	}
+}
+
+// archiveTable copies the rows into <history>_archive,
+// which follows the columns of the history table
+func (p *pruner) archiveTable(ids []uint64) error {
+	arch := p.hist + "_archive"
+	dialect := dialectOf(p.dbo)
+	if err := p.dbo.Exec(dialect.createArchive(arch, p.hist)).Error; err != nil {
+		return err
+	}
+
+	have, err := dialect.columns(p.dbo, arch)
+	if err != nil {
+		return err
+	}
+	cols, err := dialect.columns(p.dbo, p.hist)
+	if err != nil {
+		return err
+	}
+
+	exists := map[string]bool{}
+	for _, c := range have {
+		exists[c.Name] = true
+	}
+	names := []string{}
+	for _, c := range cols {
+		if !exists[c.Name] {
+			// older archived rows have no value for it
+			c.Null = "YES"
+			if err = p.dbo.Exec(dialect.addArchiveColumn(arch, c)).Error; err != nil {
+				return err
+			}
+		}
+		names = append(names, c.Name)
+	}
+
+	return p.dbo.Exec(dialect.archiveRows(arch, p.hist, names), ids).Error
+}
+
+// archiveFile appends the rows, as json lines, to a gzipped file
+// in the archive directory, which is flushed before the rows go
+func (p *pruner) archiveFile(ids []uint64) error {
+	if p.file == nil {
+		if err := os.MkdirAll(p.ret.Archive, 0755); err != nil {
+			return err
+		}
+		name := filepath.Join(p.ret.Archive, p.hist+"-"+time.Now().Format("20060102150405")+".jsonl.gz")
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		p.file = f
+		p.gz = gzip.NewWriter(f)
+		p.enc = json.NewEncoder(p.gz)
+	}
+
+	rows, err := p.dbo.Raw("SELECT * FROM "+p.table()+" WHERE row_id IN (?) ORDER BY row_id", ids).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		line := map[string]interface{}{}
+		for i, c := range cols {
+			if b, ok := vals[i].([]byte); ok {
+				line[c] = string(b)
+			} else {
+				line[c] = vals[i]
+			}
+		}
+		if err = p.enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if err = p.gz.Flush(); err != nil {
+		return err
+	}
+	return p.file.Sync()
+}
+
+func (p *pruner) close() {
+	if p.file != nil {
+		p.gz.Close()
+		p.file.Close()
+	}
+}
@@ -0,0 +1,81 @@
+package dorm
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionOf(t *testing.T) {
+	type Kept struct {
+		PKey
+		Historic `retain_days:"90" retain_versions:"20" archive:"table"`
+	}
+	type Forever struct {
+		PKey
+		Historic
+	}
+
+	assert.Equal(t, Retention{Days: 90, Versions: 20, Archive: ArchiveTable, Batch: 1000}, RetentionOf(&Kept{}))
+	assert.Equal(t, Retention{Batch: 1000}, RetentionOf(Forever{}))
+}
+
+func TestPruneSQL(t *testing.T) {
+	assert.Equal(t, "SELECT id FROM zoom_product WHERE actioned_at < NOW() - INTERVAL ? SECOND GROUP BY id HAVING COUNT(*) > 1 ORDER BY id LIMIT ?", pruneIDsSQL("zoom_product", "actioned_at < "+mysqlSQL{}.ago(), 1, false))
+	assert.Equal(t, "SELECT id FROM zoom_product WHERE 1 = 1 AND id > ? GROUP BY id HAVING COUNT(*) > 20 ORDER BY id LIMIT ?", pruneIDsSQL("zoom_product", "1 = 1", 20, true))
+	assert.Equal(t, "SELECT row_id FROM (SELECT row_id, ROW_NUMBER() OVER (PARTITION BY id ORDER BY row_id DESC) AS dorm_n FROM zoom_product WHERE id IN (?) AND 1 = 1) v WHERE dorm_n > 20 ORDER BY row_id", pruneSQL("zoom_product", "1 = 1", 20))
+}
+
+func TestPrune(t *testing.T) {
+	dbo, f := newFakeDB(t)
+	f.on("AND id > ?", fakeReply{cols: []string{"id"}})
+	f.on("SELECT id FROM `zoom_product`", fakeReply{cols: []string{"id"}, rows: [][]driver.Value{{int64(4)}, {int64(9)}}})
+	f.on("SELECT row_id FROM", fakeReply{cols: []string{"row_id"}, rows: [][]driver.Value{{int64(11)}, {int64(12)}, {int64(30)}}})
+
+	p := &pruner{dbo: dbo, hist: "zoom_product", ret: Retention{Batch: 2}}
+	assert.Nil(t, p.prune("actioned_at < "+mysqlSQL{}.ago(), 1, 86400))
+	assert.Equal(t, 3, p.count)
+
+	// the cutoff is a parameter of the database clock, and rows are
+	// ranked among the ids of the batch only
+	_, args, _ := f.find("SELECT id FROM")
+	assert.Equal(t, []driver.Value{int64(86400), int64(2)}, args)
+	stmt, args, _ := f.find("SELECT row_id FROM")
+	assert.Contains(t, stmt, "WHERE id IN (?,?) AND actioned_at < NOW() - INTERVAL ? SECOND")
+	assert.Equal(t, []driver.Value{"4", "9", int64(86400)}, args)
+
+	// rows go in batches, and ids are paged after the last one
+	stmts, _ := f.sent()
+	deletes := 0
+	for _, s := range stmts {
+		if strings.HasPrefix(s, "DELETE FROM `zoom_product`") {
+			deletes++
+		}
+	}
+	assert.Equal(t, 2, deletes)
+	_, args, _ = f.find("AND id > ?")
+	assert.Equal(t, []driver.Value{int64(86400), "9", int64(2)}, args)
+}
+
+func TestArchiveTable(t *testing.T) {
+	dbo, f := newFakeDBOf(t, "postgres")
+	cols := []string{"Field", "Type", "Null", "Key", "Default", "Extra"}
+	f.on("to_regclass", fakeReply{cols: cols, rows: [][]driver.Value{
+		{"row_id", "bigint", "NO", "", nil, ""},
+		{"id", "integer", "YES", "", nil, ""},
+	}})
+
+	p := &pruner{dbo: dbo, hist: "zoom_product", ret: Retention{Archive: ArchiveTable, Batch: 2}}
+	assert.Nil(t, p.remove([]uint64{11, 12}))
+
+	// the archive is created, filled and pruned in the dialect
+	_, _, ok := f.find(`CREATE TABLE IF NOT EXISTS "zoom_product_archive" (LIKE "zoom_product" INCLUDING INDEXES)`)
+	assert.True(t, ok)
+	_, args, ok := f.find(`INSERT INTO "zoom_product_archive" ("row_id", "id") SELECT "row_id", "id" FROM "zoom_product" WHERE row_id IN ($1,$2) ON CONFLICT (row_id) DO NOTHING`)
+	assert.True(t, ok)
+	assert.Equal(t, []driver.Value{int64(11), int64(12)}, args)
+	_, _, ok = f.find(`DELETE FROM "zoom_product" WHERE row_id IN ($1,$2)`)
+	assert.True(t, ok)
+}
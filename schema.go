@@ -1,12 +1,14 @@
 package dorm
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/jinzhu/gorm"
 	"github.com/rightjoin/fig"
-	"github.com/rightjoin/rutl/conv"
 	"github.com/rightjoin/rutl/refl"
 )
 
@@ -21,7 +23,11 @@ var behave = map[interface{}][]string{}
 
 // dynamic behaviours, wherein trigger definition depends
 // upon some model property
-var behaveModel = map[interface{}]func(interface{}) []string{}
+var behaveModel = map[interface{}]dynamicBehavior{}
+
+// dynamicBehavior builds the statements of a behavior from the
+// model, and from the database (of the handle) it is built upon
+type dynamicBehavior func(dbo *gorm.DB, model interface{}) []string
 
 type triggered interface {
 	Triggers() []string
@@ -42,64 +48,150 @@ func db() *gorm.DB {
 }
 
 func BuildSchema(models ...interface{}) {
+	if err := BuildSchemaE(models...); err != nil {
+		panic(err)
+	}
+}
+
+// BuildSchemaE is BuildSchema, returning a *SchemaError that
+// tells which model, phase and statement failed, instead
+// of panicking.
+// The build is done holding the cluster wide LockSchema, so
+// that servers deploying together do not build the schema at
+// the same time. Servers that lose the race wait for the lock,
+// and then find their work already done
+func BuildSchemaE(models ...interface{}) (err error) {
+	b := newSchemaBuilder(false)
+	if b.dbo == nil {
+		return &SchemaError{Phase: PhaseLock, Err: errors.New("connection is null. Please specify the DB to populate")}
+	}
+
+	err = WithDBLock(b.dbo, LockSchema, func() (err error) {
+		defer b.catch(&err)
+		b.build(models...)
+		return nil
+	})
+	if _, ok := err.(*SchemaError); err != nil && !ok {
+		err = &SchemaError{Phase: PhaseLock, Statement: "GET_LOCK " + LockSchema, Err: err}
+	}
+	return err
+}
+
+// checkModel validates the tags of the model that
+// Insert and Update read, ahead of any write
+func checkModel(model interface{}) error {
+	if _, _, err := ulidSpec(model); err != nil {
+		return err
+	}
+	if _, err := blindIndexes(model); err != nil {
+		return err
+	}
+	return nil
+}
+
+// build runs every phase of the schema build
+// for the given models, one phase at a time
+func (b *schemaBuilder) build(models ...interface{}) {
 
 	// validations
-	if db() == nil {
-		panic("connection is null. Please specify the DB to populate")
+	if b.dbo == nil {
+		panic(&SchemaError{Phase: PhaseAutoMigrate, Err: errors.New("connection is null. Please specify the DB to populate")})
 	}
 
-	// migrate (build basic tables)
+	// tags that are read upon every write
 	for _, model := range models {
-		e := db().AutoMigrate(model).Error
-		if e != nil {
-			panic(e)
+		b.at(model, PhaseValidate)
+		if err := checkModel(model); err != nil {
+			panic(err)
 		}
+		b.checkSoftCascades(model, models)
+	}
+
+	// checksums of objects generated by earlier builds
+	b.at(SchemaObject{}, PhaseAutoMigrate)
+	b.setupObjectTable()
+
+	// functions used by the behaviors
+	for _, fn := range b.sql.functions() {
+		b.table, b.phase = fn.name, PhaseFunction
+		b.function(fn.name, fn.sql)
+	}
+
+	// migrate (build basic tables)
+	for _, model := range models {
+		b.at(model, PhaseAutoMigrate)
+		b.autoMigrate(model)
 	}
 
 	// build history log
 	for _, model := range models {
 		if refl.ComposedOf(model, Historic{}) {
-			setupHistoricAuditLog(model)
+			b.at(model, PhaseHistory)
+			b.setupHistoricAuditLog(model)
 		}
 	}
 
 	// build unique indexes
 	for _, model := range models {
-		setupUniqueIndexes(model)
+		b.at(model, PhaseUniqueIndex)
+		b.setupUniqueIndexes(model)
 	}
 
 	// build normal indexes
 	for _, model := range models {
-		setupIndexes(model)
+		b.at(model, PhaseIndex)
+		b.setupIndexes(model)
 	}
 
 	// build foreign keys
 	for _, model := range models {
-		setupForeignKeys(model)
+		b.at(model, PhaseForeignKey)
+		b.setupForeignKeys(model)
 	}
 
 	// build custom behaviors
 	for _, model := range models {
-		setupBehaviors(model)
+		b.at(model, PhaseBehavior)
+		b.setupBehaviors(model)
 	}
 
 	// build custom triggers
 	for _, model := range models {
-		setupCustomTriggers(model)
+		b.at(model, PhaseTrigger)
+		b.setupCustomTriggers(model)
 	}
 
 	// initial records defined in model
 	for _, model := range models {
-		insertInitialRecords(model)
+		b.at(model, PhaseInitialRecords)
+		b.insertInitialRecords(model)
 	}
 }
 
 func CreateDatabase(name string) {
+	if err := CreateDatabaseE(name); err != nil {
+		panic(err)
+	}
+}
+
+// CreateDatabaseE is CreateDatabase, returning a *SchemaError
+// instead of panicking
+func CreateDatabaseE(name string) (err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = asSchemaError(r, name, PhaseCreateDatabase)
+		}
+	}()
+
+	engine := fig.String("database.master.engine")
+	if engine == "postgres" || engine == "postgre" {
+		return createPostgresDatabase(name)
+	}
 
 	// Don't use master db connection, as it
 	// will try to connect to a non-existing database.
 	// So replace db name with information_schema
-	engine := fig.String("database.master.engine")
 	conn := GetCstrConfig(engine, "database.master")
 	currentDB := fig.String("database.master.db")
 	// Replace last occurance of dbname (as others may be there as part of hostname)
@@ -107,92 +199,69 @@ func CreateDatabase(name string) {
 	conn = conn[:index] + strings.Replace(conn[index:], currentDB, "information_schema", -1)
 	schema := GetORMCstr(engine, conn)
 
+	exec := func(phase string, sql string) error {
+		if e := schema.Exec(sql).Error; e != nil {
+			return &SchemaError{Table: name, Phase: phase, Statement: sql, Err: e}
+		}
+		return nil
+	}
+
 	// Create the new database
-	err := schema.Exec("CREATE DATABASE IF NOT EXISTS " + name + " CHARACTER SET utf8 COLLATE utf8_general_ci").Error
+	err = exec(PhaseCreateDatabase, "CREATE DATABASE IF NOT EXISTS "+name+" CHARACTER SET utf8 COLLATE utf8_general_ci")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// Switch to new db (from information schema)
-	err = schema.Exec("USE " + name).Error
+	err = exec(PhaseCreateDatabase, "USE "+name)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// Create the needed functions::
-
-	// function: url cleanup
-	err = schema.Exec(`CREATE FUNCTION geturl( str VARCHAR(256) ) RETURNS VARCHAR(256)
-	DETERMINISTIC
-	READS SQL DATA
-	BEGIN
-		DECLARE i, len SMALLINT DEFAULT 1;
-		DECLARE ret VARCHAR(256) DEFAULT '';
-		DECLARE c VARCHAR(1);
-		DECLARE prev VARCHAR(1);
-
-		SET str = LCASE(TRIM(str));
-		SET len = CHAR_LENGTH(str);
-
-		REPEAT
-			BEGIN
-				SET c = MID( str, i, 1 );
-				IF c REGEXP '[[:alnum:]]' OR c IN ('-','_',' ') THEN
-					IF c = ' ' THEN
-						SET c = '-';
-					END IF;
-					IF prev = '-' AND c = '-' THEN
-						# do nothing
-						SET c = '-';
-					ELSE
-						SET ret=CONCAT(ret,c);
-					END IF;
-					SET prev = c;
-				END IF;
-				SET i = i + 1;
-			END;
-		UNTIL i > len END REPEAT;
-		RETURN ret;
-	END`).Error
-	if err != nil {
-		panic(err)
-	}
-
-	// function: random string generator
-	err = schema.Exec(`CREATE FUNCTION randstr (length SMALLINT(3)) RETURNS varchar(100)
-	DETERMINISTIC
-	READS SQL DATA
-	BEGIN
-		SET @returnStr = '';
-		SET @allowedChars = 'ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789';
-		SET @i = 0;
-
-		WHILE (@i < length) DO
-			SET @returnStr = CONCAT(@returnStr, substring(@allowedChars, FLOOR(RAND() * LENGTH(@allowedChars) + 1), 1));
-			SET @i = @i + 1;
-		END WHILE;
-
-		RETURN @returnStr;
-	END`).Error
-	if err != nil {
-		panic(err)
+	for _, fn := range mysqlFunctions {
+		err = exec(PhaseFunction, "DROP FUNCTION IF EXISTS "+fn.name)
+		if err != nil {
+			return err
+		}
+		err = exec(PhaseFunction, fn.sql)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Switch back underlying connection to
 	// information_schema (as the connection was opened to it only)
-	err = schema.Exec("USE information_schema").Error
-	if err != nil {
+	return exec(PhaseCreateDatabase, "USE information_schema")
+}
+
+func DropDatabase(name string) {
+	if err := DropDatabaseE(name); err != nil {
 		panic(err)
 	}
 }
 
-func DropDatabase(name string) {
+// DropDatabaseE is DropDatabase, returning a *SchemaError
+// instead of panicking. An empty name drops the master database
+func DropDatabaseE(name string) error {
 
 	dbo := db()
+	if dbo == nil {
+		return &SchemaError{Table: name, Phase: PhaseDropDatabase, Err: errors.New("connection is null. Please specify the DB to drop")}
+	}
 	dbname := fig.String("database.master.db")
-	err := db().Exec("drop database " + dbname).Error
+	if name == "" {
+		name = dbname
+	}
+	sql := "drop database " + dbo.Dialect().Quote(name)
+	err := dbo.Exec(sql).Error
 	if err != nil {
-		panic(err)
+		return &SchemaError{Table: name, Phase: PhaseDropDatabase, Statement: sql, Err: err}
+	}
+
+	// the connection still points to a database that exists
+	if name != dbname {
+		return nil
 	}
 
 	// Now the connection points to database that
@@ -209,269 +278,370 @@ func DropDatabase(name string) {
 		delete(connections, match)
 	}
 
+	return nil
 }
 
 func PopulateRows(records ...interface{}) {
-	for _, row := range records {
-		txn := db().Begin()
+	if err := PopulateRowsE(records...); err != nil {
+		panic(err)
+	}
+}
 
-		err := txn.Create(row).Error
-		if err != nil {
-			txn.Rollback()
-			panic(err)
-		}
+// PopulateRowsE is PopulateRows, returning a *SchemaError
+// instead of panicking
+func PopulateRowsE(records ...interface{}) error {
+	return PopulateDBE(db(), records...)
+}
 
-		txn.Commit()
+func PopulateDB(dbo *gorm.DB, records ...interface{}) {
+	if err := PopulateDBE(dbo, records...); err != nil {
+		panic(err)
 	}
 }
 
-func PopulateDB(dbo *gorm.DB, records ...interface{}) {
+// PopulateDBE is PopulateDB, returning a *SchemaError (that
+// carries the failed insert) instead of panicking. Records
+// inserted before the failure remain inserted
+func PopulateDBE(dbo *gorm.DB, records ...interface{}) error {
 	for _, row := range records {
 		txn := dbo.Begin()
 
 		err := txn.Create(row).Error
 		if err != nil {
 			txn.Rollback()
-			panic(err)
+			b := &schemaBuilder{dbo: dbo}
+			return &SchemaError{Table: Table(row), Phase: PhasePopulate, Statement: b.insertSQL(row), Err: err}
 		}
 
-		txn.Commit()
-	}
-}
-
-// setupUniqueIndexes uses the following formats to
-// create a unique index
-// unique:"true"
-// unique:"idx_name"
-// unique:"idx_name(field1,field2)"
-func setupUniqueIndexes(model interface{}) {
-	fields := refl.NestedFields(model)
-	for i := 0; i < len(fields); i++ {
-		fld := fields[i]
-		if len(fld.Tag.Get("unique")) > 0 {
-			name := fld.Tag.Get("unique")
-			if name == "true" { // generate index name
-				name = "idx_" + conv.CaseSnake(fld.Name) + "_unique"
-			}
-			lbrace := strings.Index(name, "(")
-			if lbrace == -1 {
-				err := db().Model(model).AddUniqueIndex(name, conv.CaseSnake(fld.Name)).Error
-				if err != nil {
-					panic(err)
-				}
-			} else {
-				fldCsv := name[lbrace+1 : len(name)-1]
-				flds := strings.Split(fldCsv, ",")
-				for i := range flds {
-					flds[i] = strings.TrimSpace(flds[i])
-				}
-				err := db().Model(model).AddUniqueIndex(name[:lbrace], flds...).Error
-				if err != nil {
-					panic(err)
-				}
-			}
+		err = txn.Commit().Error
+		if err != nil {
+			return &SchemaError{Table: Table(row), Phase: PhasePopulate, Err: err}
 		}
 	}
-
+	return nil
 }
 
-// setupIndexes uses the following given formats
-// to create an index on the underlying table
-// index:"true"
-// index:"idx_name"
-// index:"idx_name(field1,field2)"
-func setupIndexes(model interface{}) {
-	fields := refl.NestedFields(reflect.ValueOf(model).Elem().Interface())
-	for i := 0; i < len(fields); i++ {
-		fld := fields[i]
-		if len(fld.Tag.Get("index")) > 0 {
-			name := fld.Tag.Get("index")
-			if name == "true" { // generate index name
-				name = "idx_" + conv.CaseSnake(fld.Name)
-			}
-			lbrace := strings.Index(name, "(")
-			if lbrace == -1 {
-				err := db().Model(model).AddIndex(name, conv.CaseSnake(fld.Name)).Error
-				if err != nil {
-					panic(err)
-				}
-			} else {
-				fldCsv := name[lbrace+1 : len(name)-1]
-				flds := strings.Split(fldCsv, ",")
-				for i := range flds {
-					flds[i] = strings.TrimSpace(flds[i])
-				}
-				err := db().Model(model).AddIndex(name[:lbrace], flds...).Error
-				if err != nil {
-					panic(err)
-				}
-			}
+func (b *schemaBuilder) autoMigrate(model interface{}) {
+	tbl := Table(model)
+
+	if b.dryRun {
+		for _, sql := range b.migrateSQL(model) {
+			b.exec(tbl, PhaseAutoMigrate, sql)
 		}
+		return
 	}
 
-}
-
-// setupForeignKeys configures foreign keys in the
-// underlying db using the format below
-// fk:"table_name(identity_key)"
-func setupForeignKeys(model interface{}) {
-	modelType := reflect.TypeOf(model).Elem()
-	num := modelType.NumField()
-	for i := 0; i < num; i++ {
-		fld := modelType.FieldByIndex([]int{i})
-		tag := fld.Tag
-		if len(tag.Get("fk")) > 0 {
-			fk := conv.CaseSnake(fld.Name)
-			err := db().Model(model).AddForeignKey(fk, tag.Get("fk"), "RESTRICT", "RESTRICT").Error
-			if err != nil {
-				panic(err)
-			}
-		}
+	b.plan = append(b.plan, Step{Table: tbl, Phase: PhaseAutoMigrate, SQL: "AutoMigrate " + tbl})
+	e := b.dbo.AutoMigrate(model).Error
+	if e != nil {
+		panic(&SchemaError{Table: tbl, Phase: PhaseAutoMigrate, Statement: "AutoMigrate " + tbl, Err: e})
 	}
 }
 
 // setupCustomTriggers creates the given triggers.
 // The triggers must be specified in the Triggers()
 // method, that returns an array of strings
-func setupCustomTriggers(model interface{}) {
+func (b *schemaBuilder) setupCustomTriggers(model interface{}) {
 	if m, ok := model.(triggered); ok {
 		triggers := m.Triggers()
 		for _, trig := range triggers {
-			err := db().Exec(trig).Error
-			if err != nil {
-				panic(err)
-			}
+			b.trigger(Table(model), PhaseTrigger, trig)
 		}
 	}
 }
 
-func setupBehaviors(model interface{}) {
+func (b *schemaBuilder) setupBehaviors(model interface{}) {
+	tbl := Table(model)
+	for _, stmt := range behaviorStatements(b.sql, b.dbo, model) {
+		b.trigger(tbl, PhaseBehavior, stmt)
+	}
+}
+
+// behaviorStatements returns the statements (mostly triggers) of
+// all behaviors that the model is composed of, with <<Table>>
+// filled in. Behaviors are skipped for "zoom_" tables
+func behaviorStatements(sd sqlDialect, dbo *gorm.DB, model interface{}) []string {
 
 	tbl := Table(model)
+	out := []string{}
 
 	// skip behaviours for "zoom_" tables
 	if strings.HasPrefix(tbl, "zoom_") {
-		return
+		return out
 	}
 
-	exec := func(inp string) {
-		inp = strings.Replace(inp, "<<Table>>", tbl, -1)
-		err := db().Exec(inp).Error
-		if err != nil {
-			panic(err)
-		}
+	add := func(inp string) {
+		out = append(out, strings.Replace(inp, "<<Table>>", tbl, -1))
 	}
 
-	// static behaviors
-	for obj, triggs := range behave {
-		if refl.ComposedOf(model, obj) {
+	// behaviors are applied in the order in which
+	// they are declared in the model, so that the
+	// plan (and trigger order) is always the same
+	behave, behaveModel := sd.behaviors()
+	for _, obj := range behaviorsOf(behave, behaveModel, model) {
+
+		// static behaviors
+		if triggs, ok := behave[obj]; ok {
 			for _, t := range triggs {
-				exec(t)
+				add(t)
 			}
 		}
-	}
 
-	// dynamic behaviors
-	for obj, fn := range behaveModel {
-		if refl.ComposedOf(model, obj) {
-			triggs := fn(model)
+		// dynamic behaviors
+		if fn, ok := behaveModel[obj]; ok {
+			triggs := fn(dbo, model)
 			for _, t := range triggs {
-				exec(t)
+				add(t)
 			}
 		}
 	}
 
+	return out
 }
 
-func setupHistoricAuditLog(model interface{}) {
+// behaviorsOf returns the behaviors (static or dynamic)
+// that the model is composed of, in declaration order
+func behaviorsOf(behave map[interface{}][]string, behaveModel map[interface{}]dynamicBehavior, model interface{}) []interface{} {
 
-	tbl := Table(model)
-	hist := historyPrefix + tbl
+	type found struct {
+		obj   interface{}
+		index []int
+	}
+	list := []found{}
 
-	exec := func(inp string) {
-		inp = strings.Replace(inp, "<<Table>>", hist, -1)
-		inp = strings.Replace(inp, "<<TableOrig>>", tbl, -1)
-		err := db().Exec(inp).Error
-		if err != nil {
-			panic(err)
+	add := func(obj interface{}) {
+		if refl.ComposedOf(model, obj) {
+			t := reflect.TypeOf(model)
+			if t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			f, _ := t.FieldByName(reflect.TypeOf(obj).Name())
+			list = append(list, found{obj, f.Index})
 		}
 	}
-
-	type Field struct {
-		Name    string  `gorm:"column:Field"`
-		Type    string  `gorm:"column:Type"`
-		Null    string  `gorm:"column:Null"`
-		Key     string  `gorm:"column:Key"`
-		Default *string `gorm:"column:Default"`
-		Extra   string  `gorm:"column:Extra"`
+	for obj := range behave {
+		add(obj)
 	}
-	var flds []Field
-
-	info := func(f Field) string {
-		key := f.Name + " " + f.Type
-		if f.Null == "NO" {
-			key += " NOT NULL"
+	for obj := range behaveModel {
+		if _, ok := behave[obj]; !ok {
+			add(obj)
 		}
-		if f.Default != nil {
-			key += " DEFAULT " + *(f.Default)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].index, list[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
 		}
-		return key + " " + f.Extra
+		return len(a) < len(b)
+	})
+
+	out := make([]interface{}, len(list))
+	for i := range list {
+		out[i] = list[i].obj
 	}
+	return out
+}
 
-	// create table alike
-	exec("CREATE TABLE <<Table>> LIKE <<TableOrig>>;")
+// showColumn is a row returned by "SHOW COLUMNS"
+type showColumn struct {
+	Name    string  `gorm:"column:Field"`
+	Type    string  `gorm:"column:Type"`
+	Null    string  `gorm:"column:Null"`
+	Key     string  `gorm:"column:Key"`
+	Default *string `gorm:"column:Default"`
+	Extra   string  `gorm:"column:Extra"`
+}
 
-	// remove auto increment (if any)
-	sql := "SHOW COLUMNS FROM " + hist + " WHERE Extra LIKE '%auto_increment%'"
-	err := db().Raw(sql).Find(&flds).Error
-	if err != nil {
-		panic(err)
+// definition returns the column definition, as
+// used by ALTER TABLE ... MODIFY
+func (f showColumn) definition() string {
+	key := f.Name + " " + f.Type
+	if f.Null == "NO" {
+		key += " NOT NULL"
 	}
-	if flds != nil && len(flds) > 0 {
-		for _, f := range flds {
-			exec("ALTER TABLE <<Table>> MODIFY " + strings.Replace(info(f), "auto_increment", "", -1))
-		}
+	if f.Default != nil {
+		key += " DEFAULT " + *(f.Default)
 	}
+	return key + " " + f.Extra
+}
 
-	// drop primary key (if any)
-	sql = "SHOW COLUMNS FROM " + hist + " WHERE `Key` = 'PRI'"
-	err = db().Raw(sql).Find(&flds).Error
-	if err != nil {
-		panic(err)
+// showColumns lists the columns of the table that
+// match the given condition
+func showColumns(dbo *gorm.DB, table string, where string) ([]showColumn, error) {
+	var flds []showColumn
+	err := dbo.Raw("SHOW COLUMNS FROM " + table + " WHERE " + where).Find(&flds).Error
+	return flds, err
+}
+
+// insertInitialRecords inserts each of the model's initial
+// records once. Records are identified by their primary key, or
+// else by a unique index whose columns they set: a record whose
+// row exists is left as it is, unless the record has been edited
+// since, in which case the row is updated. Records without such
+// a key are identified by their checksum, so an edited one is
+// inserted again as a new one
+func (b *schemaBuilder) insertInitialRecords(model interface{}) {
+	m, ok := model.(populateRows)
+	if !ok {
+		return
 	}
-	if flds != nil && len(flds) > 0 {
-		exec("ALTER TABLE <<Table>> DROP PRIMARY KEY")
+	tbl := Table(model)
+	recs := m.InitialRecords()
+
+	// records populated before they were versioned: the table
+	// has rows, but none of its records have been recorded
+	adopt := false
+	if b.hasTable(tbl) {
+		adopt = true
+		for _, r := range recs {
+			if b.recordCurrent(r) != "" {
+				adopt = false
+			}
+		}
+		if adopt {
+			var count int
+			b.dbo.Raw("SELECT count(*) FROM " + tbl).Row().Scan(&count)
+			adopt = count > 0
+		}
 	}
 
-	// add columns: row_id, action and actioned_at
-	exec("ALTER TABLE <<Table>> ADD COLUMN row_id bigint unsigned first, ADD COLUMN action varchar(6) not null default 'insert' after row_id, ADD COLUMN actioned_at DATETIME not null default current_timestamp after action")
+	for _, row := range recs {
+		sql := b.insertSQL(row)
+		sum := checksum(sql)
+		name := sum
+		if b.recordCurrent(row) == sum {
+			continue
+		}
 
-	// set primary key and auto_increment on row_id
-	exec("ALTER TABLE <<Table>> ADD PRIMARY KEY (row_id)")
-	exec("ALTER TABLE <<Table>> MODIFY COLUMN row_id BIGINT UNSIGNED auto_increment")
+		if key, where, args, ok := b.recordKey(row); ok {
+			name = recordName(tbl, key)
+			if b.recordExists(tbl, where, args) {
+				// rows of records that were never recorded are adopted,
+				// and those of edited records are updated
+				if _, recorded := b.versions[ObjectRecord+":"+name]; recorded {
+					b.updateRecord(tbl, row, where, args)
+				}
+				b.record(tbl, PhaseInitialRecords, ObjectRecord, name, sum)
+				continue
+			}
+		} else if adopt {
+			b.record(tbl, PhaseInitialRecords, ObjectRecord, name, sum)
+			continue
+		}
 
-	// setup triggers on original/base table::
+		if b.dryRun {
+			b.exec(tbl, PhaseInitialRecords, sql)
+		} else {
+			b.plan = append(b.plan, Step{Table: tbl, Phase: PhaseInitialRecords, SQL: sql})
+			if err := PopulateDBE(b.dbo, row); err != nil {
+				panic(&SchemaError{Table: tbl, Phase: PhaseInitialRecords, Statement: sql, Err: errors.Unwrap(err)})
+			}
+		}
+		b.record(tbl, PhaseInitialRecords, ObjectRecord, name, sum)
+	}
+}
 
-	exec("DROP TRIGGER IF EXISTS <<TableOrig>>_audit_trail_insert")
-	exec(`CREATE TRIGGER <<TableOrig>>_audit_trail_insert AFTER INSERT ON <<TableOrig>> FOR EACH ROW
-        INSERT INTO <<Table>> SELECT null,'insert',NOW(), src.* 
-        FROM <<TableOrig>> as src WHERE src.id = NEW.id;`)
+// recordCurrent returns the checksum that the initial record
+// was last recorded with, by its key (or by its checksum, as
+// records were recorded before they were keyed), if any
+func (b *schemaBuilder) recordCurrent(row interface{}) string {
+	sum := checksum(b.insertSQL(row))
+	if _, ok := b.versions[ObjectRecord+":"+sum]; ok {
+		return sum
+	}
+	if key, _, _, ok := b.recordKey(row); ok {
+		return b.versions[ObjectRecord+":"+recordName(Table(row), key)]
+	}
+	return ""
+}
 
-	exec("DROP TRIGGER IF EXISTS <<TableOrig>>_audit_trail_update")
-	exec(`CREATE TRIGGER <<TableOrig>>_audit_trail_update AFTER UPDATE ON <<TableOrig>> FOR EACH ROW
-        INSERT INTO <<Table>> SELECT null,'update',NOW(), src.* 
-        FROM <<TableOrig>> as src WHERE src.id = NEW.id;`)
+// recordKey returns the key that identifies the initial record
+// (as in id=1), and the condition (with its parameters) that
+// finds its row: by the primary key, or else by the first unique
+// index whose columns are all set in the record
+func (b *schemaBuilder) recordKey(row interface{}) (string, string, []interface{}, bool) {
+	scope := b.dbo.NewScope(row)
+	match := func(fields []*gorm.Field) (string, string, []interface{}, bool) {
+		keys, conds, args := []string{}, []string{}, []interface{}{}
+		for _, f := range fields {
+			if f == nil || f.IsBlank {
+				return "", "", nil, false
+			}
+			keys = append(keys, f.DBName+"="+fmt.Sprint(f.Field.Interface()))
+			conds = append(conds, scope.Quote(f.DBName)+" = ?")
+			args = append(args, f.Field.Interface())
+		}
+		return strings.Join(keys, ","), strings.Join(conds, " AND "), args, len(fields) > 0
+	}
+
+	if key, where, args, ok := match(scope.PrimaryFields()); ok {
+		return key, where, args, true
+	}
+	for _, idx := range modelIndexes(row) {
+		if !idx.Unique {
+			continue
+		}
+		fields := []*gorm.Field{}
+		for _, p := range idx.Parts {
+			f, _ := scope.FieldByName(p.Column)
+			if p.Expr != "" || p.Length > 0 {
+				f = nil
+			}
+			fields = append(fields, f)
+		}
+		if key, where, args, ok := match(fields); ok {
+			return key, where, args, true
+		}
+	}
+	return "", "", nil, false
+}
 
-	exec("DROP TRIGGER IF EXISTS <<TableOrig>>_audit_trail_delete")
-	exec(`CREATE TRIGGER <<TableOrig>>_audit_trail_delete BEFORE DELETE ON <<TableOrig>> FOR EACH ROW
-        INSERT INTO <<Table>> SELECT null,'delete',NOW(), src.* 
-        FROM <<TableOrig>> as src WHERE src.id = OLD.id;`)
+// recordName is the name that an initial record is recorded
+// by, which fits the name column of schema_object
+func recordName(tbl string, key string) string {
+	name := tbl + ":" + key
+	if len(name) > 191 {
+		name = tbl + ":" + checksum(key)
+	}
+	return name
+}
 
+// recordExists tells if the table has the row of an initial record
+func (b *schemaBuilder) recordExists(tbl string, where string, args []interface{}) bool {
+	if !b.hasTable(tbl) {
+		return false
+	}
+	var count int
+	err := b.dbo.Raw("SELECT count(*) FROM "+b.dbo.Dialect().Quote(tbl)+" WHERE "+where, args...).Row().Scan(&count)
+	if err != nil {
+		panic(&SchemaError{Table: tbl, Phase: PhaseInitialRecords, Err: err})
+	}
+	return count > 0
 }
 
-func insertInitialRecords(model interface{}) {
-	if m, ok := model.(populateRows); ok {
-		recs := m.InitialRecords()
-		PopulateRows(recs...)
+// updateRecord writes the (edited) initial record to its row
+func (b *schemaBuilder) updateRecord(tbl string, row interface{}, where string, args []interface{}) {
+	scope := b.dbo.NewScope(row)
+	set := []string{}
+	vals := map[string]interface{}{}
+	for _, f := range scope.Fields() {
+		if !f.IsNormal || f.IsIgnored || f.IsPrimaryKey || (f.IsBlank && f.HasDefaultValue) {
+			continue
+		}
+		set = append(set, scope.Quote(f.DBName)+"="+sqlLiteral(f.Field.Interface()))
+		vals[f.DBName] = f.Field.Interface()
+	}
+	sort.Strings(set)
+
+	sql := fmt.Sprintf("UPDATE %s SET %s WHERE %s", scope.QuotedTableName(), strings.Join(set, ","), where)
+	b.plan = append(b.plan, Step{Table: tbl, Phase: PhaseInitialRecords, SQL: sql})
+	if b.dryRun {
+		return
+	}
+	if err := b.dbo.Table(tbl).Where(where, args...).Updates(vals).Error; err != nil {
+		panic(&SchemaError{Table: tbl, Phase: PhaseInitialRecords, Statement: sql, Err: err})
 	}
 }
@@ -0,0 +1,125 @@
+package dorm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/rutl/refl"
+)
+
+// ErrNotSoftDelete is returned when rows of a model that
+// does not compose SoftDelete (or SoftDelete4) are soft deleted
+var ErrNotSoftDelete = errors.New("model does not soft delete")
+
+// setting of a handle that hides soft deleted rows
+const softScopedKey = "dorm:soft_scoped"
+
+func init() {
+	gorm.DefaultCallback.Query().Before("gorm:query").Register("dorm:soft_scoped", softScope)
+	gorm.DefaultCallback.RowQuery().Before("gorm:row_query").Register("dorm:soft_scoped", softScope)
+}
+
+// SoftScoped returns a handle upon which queries of models that
+// compose SoftDelete (or SoftDelete4) skip the deleted rows. Raw
+// sql is left as it is
+func SoftScoped(dbo *gorm.DB) *gorm.DB {
+	return dbo.Set(softScopedKey, true)
+}
+
+// softScope filters out the deleted rows of the query,
+// when run upon a SoftScoped handle
+func softScope(scope *gorm.Scope) {
+	if on, ok := scope.Get(softScopedKey); !ok || on != true || scope.Value == nil {
+		return
+	}
+	t := scope.GetModelStruct().ModelType
+	if t == nil || t.Kind() != reflect.Struct {
+		return
+	}
+	if isSoftDelete(reflect.New(t).Elem().Interface()) {
+		scope.Search.Where(fmt.Sprintf("%s.%s = 0", scope.QuotedTableName(), scope.Quote("deleted")))
+	}
+}
+
+func isSoftDelete(model interface{}) bool {
+	return refl.ComposedOf(model, SoftDelete{}) || refl.ComposedOf(model, SoftDelete4{})
+}
+
+// SoftDeleteRow marks the row (of the given id) as deleted.
+// Data holds any other columns to update, such as "who"
+func SoftDeleteRow(dbo *gorm.DB, addr interface{}, id interface{}, data ...interface{}) error {
+	return setDeleted(dbo, addr, id, "1", data...)
+}
+
+// RestoreRow undoes SoftDeleteRow
+func RestoreRow(dbo *gorm.DB, addr interface{}, id interface{}, data ...interface{}) error {
+	return setDeleted(dbo, addr, id, "0", data...)
+}
+
+func setDeleted(dbo *gorm.DB, addr interface{}, id interface{}, deleted string, data ...interface{}) error {
+	if !isSoftDelete(addr) {
+		return ErrNotSoftDelete
+	}
+
+	input := map[string]string{}
+	if len(data) > 0 {
+		input = prepareData(data...)
+	}
+	input["deleted"] = deleted
+
+	return Update(dbo, "id", id, addr, input)
+}
+
+// PurgeDeleted removes the rows of the model that were soft
+// deleted longer than olderThan ago, and returns their count.
+// Their delete is let past the trigger that blocks it by a
+// session variable, for the duration of the purge only (on
+// postgres, for the transaction, which is opened unless the
+// handle is in one already). Rows of Tenanted models are
+// purged for the handle's tenant
+func PurgeDeleted(dbo *gorm.DB, model interface{}, olderThan time.Duration) (int, error) {
+	if !isSoftDelete(model) {
+		return 0, ErrNotSoftDelete
+	}
+
+	txn := dbo.Begin()
+	if txn.Error != nil {
+		// transaction must already be running
+		return doPurge(dbo, model, olderThan)
+	}
+
+	count, err := doPurge(txn, model, olderThan)
+	if err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+
+	return count, txn.Commit().Error
+}
+
+func doPurge(txn *gorm.DB, model interface{}, olderThan time.Duration) (count int, err error) {
+	tenant, params, err := tenantWhere(txn, model)
+	if err != nil {
+		return 0, err
+	}
+
+	sd := dialectOf(txn)
+	if err = txn.Exec(sd.purge(true)).Error; err != nil {
+		return 0, err
+	}
+	defer func() {
+		if e := txn.Exec(sd.purge(false)).Error; e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	// deleted_at is stamped by the database, and so is
+	// compared with the database's clock
+	tbl := txn.Dialect().Quote(Table(model))
+	ago := int64(olderThan / time.Second)
+	res := txn.Exec("DELETE FROM "+tbl+" WHERE deleted = 1 AND deleted_at < "+sd.ago()+tenant, append([]interface{}{ago}, params...)...)
+	return int(res.RowsAffected), res.Error
+}
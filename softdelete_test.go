@@ -0,0 +1,67 @@
+package dorm
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSoftDelete(t *testing.T) {
+	type note struct {
+		PKey
+		SoftDelete4
+	}
+	assert.True(t, isSoftDelete(note{}))
+	assert.True(t, isSoftDelete(&note{}))
+	assert.False(t, isSoftDelete(PKey{}))
+
+	assert.Equal(t, ErrNotSoftDelete, SoftDeleteRow(nil, &PKey{}, 1))
+	_, err := PurgeDeleted(nil, &PKey{}, time.Hour)
+	assert.Equal(t, ErrNotSoftDelete, err)
+}
+
+type memo struct {
+	PKey
+	Body string `sql:"TYPE:varchar(64)" json:"body"`
+	SoftDelete
+}
+
+func TestSoftScoped(t *testing.T) {
+	dbo, f := newFakeDB(t)
+
+	var memos []memo
+	assert.Nil(t, SoftScoped(dbo).Where("body = ?", "a").Find(&memos).Error)
+	stmt, _, _ := f.find("SELECT * FROM `memo`")
+	assert.Contains(t, stmt, "`memo`.`deleted` = 0")
+	assert.Contains(t, stmt, "body = ?")
+
+	// unscoped handles, and models that do not soft delete, are left as they are
+	assert.Nil(t, dbo.Find(&memos).Error)
+	assert.Nil(t, SoftScoped(dbo).Find(&[]shade{}).Error)
+	stmts, _ := f.sent()
+	assert.NotContains(t, stmts[1], "`deleted` = 0")
+	assert.NotContains(t, stmts[2], "`deleted` = 0")
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	dbo, f := newFakeDB(t)
+	f.on("DELETE FROM", fakeReply{affected: 3})
+
+	count, err := PurgeDeleted(dbo, &memo{}, 48*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	// the delete is let past its trigger for the purge only, and
+	// the cutoff is reckoned by the database's clock
+	stmts, args := f.sent()
+	assert.Equal(t, []string{
+		"SET @dorm_purge = 1",
+		"DELETE FROM `memo` WHERE deleted = 1 AND deleted_at < NOW() - INTERVAL ? SECOND",
+		"SET @dorm_purge = NULL",
+	}, stmts)
+	assert.Equal(t, []driver.Value{int64(48 * 60 * 60)}, args[1])
+
+	assert.Equal(t, "SET LOCAL dorm.purge = 'on'", postgresSQL{}.purge(true))
+}
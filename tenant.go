@@ -0,0 +1,103 @@
+package dorm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/rutl/refl"
+)
+
+// Tenanted rows belong to a tenant. Insert, Update (and the other
+// operations of dorm, and gorm's queries, updates and deletes)
+// upon a Tenanted model require a handle from WithTenant (or
+// WithoutTenant): rows are inserted for that tenant, and only
+// its rows are read or written (updating a row of another tenant
+// returns gorm.ErrRecordNotFound). A trigger rejects updates that
+// change the tenant_id
+type Tenanted struct {
+	TenantID string `sql:"TYPE:varchar(64);not null;DEFAULT:''" json:"tenant_id" index:"true" insert:"no" update:"no"`
+}
+
+// ErrNoTenant is returned when rows of a Tenanted model
+// are written (or read) upon a handle without a tenant
+var ErrNoTenant = errors.New("no tenant for tenanted model")
+
+// setting of a handle that carries the tenant
+const tenantKey = "dorm:tenant"
+
+func init() {
+	gorm.DefaultCallback.Query().Before("gorm:query").Register("dorm:tenant", tenantScope)
+	gorm.DefaultCallback.RowQuery().Before("gorm:row_query").Register("dorm:tenant", tenantScope)
+	gorm.DefaultCallback.Update().Before("gorm:update").Register("dorm:tenant", tenantScope)
+	gorm.DefaultCallback.Delete().Before("gorm:delete").Register("dorm:tenant", tenantScope)
+}
+
+// WithTenant returns a handle that acts for the given tenant.
+// Queries built by gorm upon it are scoped to the tenant as well
+func WithTenant(dbo *gorm.DB, tenant string) *gorm.DB {
+	return dbo.Set(tenantKey, tenant)
+}
+
+// setting of a handle that acts for all tenants
+const tenantlessKey = "dorm:tenantless"
+
+// WithoutTenant returns a handle that reads and writes the rows
+// of all tenants, as for administration. It inserts none, as
+// rows are inserted for a tenant
+func WithoutTenant(dbo *gorm.DB) *gorm.DB {
+	return dbo.Set(tenantlessKey, true)
+}
+
+// TenantOf returns the tenant of the handle, if any
+func TenantOf(dbo *gorm.DB) (string, bool) {
+	v, ok := dbo.Get(tenantKey)
+	if !ok {
+		return "", false
+	}
+	tenant, ok := v.(string)
+	return tenant, ok && tenant != ""
+}
+
+// tenantWhere returns the condition (and its parameter) that
+// scopes the sql of a Tenanted model to the handle's tenant. It
+// is empty for other models
+func tenantWhere(dbo *gorm.DB, model interface{}) (string, []interface{}, error) {
+	if !refl.ComposedOf(model, Tenanted{}) {
+		return "", nil, nil
+	}
+	if all, ok := dbo.Get(tenantlessKey); ok && all == true {
+		return "", nil, nil
+	}
+	tenant, ok := TenantOf(dbo)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %s", ErrNoTenant, Table(model))
+	}
+	return " AND " + dbo.Dialect().Quote("tenant_id") + " = ?", []interface{}{tenant}, nil
+}
+
+// tenantScope scopes the gorm statement to the tenant of the
+// handle, for Tenanted models. Without a tenant (and unless the
+// handle is WithoutTenant) the statement fails with ErrNoTenant
+func tenantScope(scope *gorm.Scope) {
+	if scope.Value == nil {
+		return
+	}
+	t := scope.GetModelStruct().ModelType
+	if t == nil || t.Kind() != reflect.Struct || !refl.ComposedOf(reflect.New(t).Elem().Interface(), Tenanted{}) {
+		return
+	}
+	if all, ok := scope.Get(tenantlessKey); ok && all == true {
+		return
+	}
+
+	tenant, ok := scope.Get(tenantKey)
+	if s, _ := tenant.(string); !ok || s == "" {
+		scope.Err(fmt.Errorf("%w: %s", ErrNoTenant, scope.TableName()))
+		// row queries run regardless of the error
+		scope.Search.Where("1 = 0")
+		return
+	}
+	scope.Search.Where(fmt.Sprintf("%s.%s = ?", scope.QuotedTableName(), scope.Quote("tenant_id")), tenant)
+}
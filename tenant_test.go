@@ -0,0 +1,109 @@
+package dorm
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantWhere(t *testing.T) {
+	type invoice struct {
+		PKey
+		Tenanted
+	}
+	dbo := &gorm.DB{}
+
+	where, params, err := tenantWhere(dbo, &PKey{})
+	assert.Nil(t, err)
+	assert.Equal(t, "", where)
+	assert.Nil(t, params)
+
+	_, _, err = tenantWhere(dbo, &invoice{})
+	assert.True(t, errors.Is(err, ErrNoTenant))
+
+	_, ok := TenantOf(dbo)
+	assert.False(t, ok)
+}
+
+type folio struct {
+	PKey
+	Title string `sql:"TYPE:varchar(64)" json:"title"`
+	Tenanted
+}
+
+func TestTenantedInsert(t *testing.T) {
+	dbo, f := newFakeDB(t)
+	err := Insert(dbo, &folio{}, "title", "a")
+	assert.True(t, errors.Is(err, ErrNoTenant), err)
+	_, _, ok := f.find("INSERT")
+	assert.False(t, ok)
+
+	assert.Nil(t, Insert(WithTenant(dbo, "acme"), &folio{}, "title", "a"))
+	stmt, args, ok := f.find("INSERT")
+	assert.True(t, ok)
+	assert.Contains(t, stmt, "`tenant_id`")
+	assert.Contains(t, args, driver.Value("acme"))
+}
+
+func TestTenantedUpdate(t *testing.T) {
+	dbo, f := newFakeDB(t)
+	err := Update(dbo, "id", 7, &folio{}, "title", "b")
+	assert.True(t, errors.Is(err, ErrNoTenant), err)
+	_, _, ok := f.find("UPDATE")
+	assert.False(t, ok)
+
+	assert.Nil(t, Update(WithTenant(dbo, "acme"), "id", 7, &folio{}, "title", "b"))
+	stmt, args, _ := f.find("UPDATE")
+	assert.Equal(t, "UPDATE `folio` SET `title`=? WHERE `id` = ? AND `tenant_id` = ?", stmt)
+	assert.Equal(t, []driver.Value{"b", int64(7), "acme"}, args)
+
+	// a row of another tenant is not found
+	dbo, f = newFakeDB(t)
+	f.on("UPDATE", fakeReply{affected: 0})
+	err = Update(WithTenant(dbo, "acme"), "id", 7, &folio{}, "title", "b")
+	assert.Equal(t, gorm.ErrRecordNotFound, err)
+	stmt, _, _ = f.find("SELECT")
+	assert.Contains(t, stmt, "SELECT `id` FROM `folio` WHERE `id` = ? AND `tenant_id` = ?")
+
+	// while one of the tenant left as it was is
+	f.on("SELECT `id`", fakeReply{cols: []string{"id"}, rows: [][]driver.Value{{"7"}}})
+	assert.Nil(t, Update(WithTenant(dbo, "acme"), "id", 7, &folio{}, "title", "b"))
+}
+
+func TestTenantScope(t *testing.T) {
+	dbo, f := newFakeDB(t)
+
+	// gorm statements without a tenant fail closed
+	err := dbo.Find(&[]folio{}).Error
+	assert.True(t, errors.Is(err, ErrNoTenant), err)
+	_, _, ok := f.find("SELECT")
+	assert.False(t, ok)
+	err = dbo.Where("id = ?", 7).Delete(&folio{}).Error
+	assert.True(t, errors.Is(err, ErrNoTenant), err)
+	_, _, ok = f.find("DELETE")
+	assert.False(t, ok)
+	rows, err := dbo.Model(&folio{}).Select("id").Rows()
+	if err == nil {
+		rows.Close()
+	}
+	stmt, _, _ := f.find("SELECT id")
+	assert.Contains(t, stmt, "1 = 0")
+
+	// and are scoped to the tenant of the handle
+	assert.Nil(t, WithTenant(dbo, "acme").Find(&[]folio{}).Error)
+	stmt, args, _ := f.find("SELECT * FROM `folio`")
+	assert.Contains(t, stmt, "`folio`.`tenant_id` = ?")
+	assert.Equal(t, []driver.Value{"acme"}, args)
+
+	// or to none, for all tenants
+	dbo, f = newFakeDB(t)
+	assert.Nil(t, WithoutTenant(dbo).Find(&[]folio{}).Error)
+	stmt, _, _ = f.find("SELECT * FROM `folio`")
+	assert.NotContains(t, stmt, "tenant_id")
+	where, _, err := tenantWhere(WithoutTenant(dbo), &folio{})
+	assert.Nil(t, err)
+	assert.Equal(t, "", where)
+}
@@ -0,0 +1,192 @@
+package dorm
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/rutl/refl"
+)
+
+func init() {
+	gorm.DefaultCallback.Create().Before("gorm:create").Register("dorm:uid", uidCreate)
+}
+
+// ULID is a uid generated by dorm (in Insert and InsertSelect,
+// and upon gorm's Create, as by PopulateDB and InitialRecords),
+// rather than by a trigger. It begins with the time of insertion,
+// so uids sort by time and are appended to the end of the index.
+// By default it is a 26 character ulid, in crockford's base32.
+// The alphabet and length are set with tags on the embedded ULID
+// ULID `alphabet:"0123456789abcdefghijklmnopqrstuvwxyz" length:"20"`
+// The characters of the alphabet must be in ascending order
+type ULID struct {
+	UID string `sql:"TYPE:varchar(32) binary;not null;DEFAULT:'';" json:"uid" unique:"true" insert:"no" update:"no"`
+}
+
+// UUID7 is a time ordered uuid (version 7), generated by dorm as
+// ULID is, in its canonical (hyphenated) form
+type UUID7 struct {
+	UID string `sql:"TYPE:char(36);not null;DEFAULT:'';" json:"uid" unique:"true" insert:"no" update:"no"`
+}
+
+const (
+	ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	ulidLength   = 26
+	ulidMax      = 32
+)
+
+// newUID generates the uid of a model composed of ULID or UUID7,
+// and tells if the model is composed of either
+func newUID(model interface{}) (string, bool, error) {
+	now := time.Now()
+
+	if refl.ComposedOf(model, UUID7{}) {
+		return newUUID7(now), true, nil
+	}
+	if !refl.ComposedOf(model, ULID{}) {
+		return "", false, nil
+	}
+
+	alphabet, length, err := ulidSpec(model)
+	if err != nil {
+		return "", true, err
+	}
+	return newULID(now, alphabet, length), true, nil
+}
+
+// ulidSpec returns the alphabet and length of the model's ULID,
+// as set by the tags on it, and validates them
+func ulidSpec(model interface{}) (string, int, error) {
+	alphabet, length := ulidAlphabet, ulidLength
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	f, ok := t.FieldByName("ULID")
+	if !ok || !f.Anonymous {
+		return alphabet, length, nil
+	}
+
+	if a, ok := f.Tag.Lookup("alphabet"); ok {
+		alphabet = a
+	}
+	if l, ok := f.Tag.Lookup("length"); ok {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			return "", 0, fmt.Errorf("ulid length of %s is not a number: %s", Table(model), l)
+		}
+		length = n
+	}
+
+	base := len(alphabet)
+	if base < 2 || !sort.SliceIsSorted([]byte(alphabet), func(i, j int) bool { return alphabet[i] < alphabet[j] }) {
+		return "", 0, fmt.Errorf("ulid alphabet of %s must have ascending characters: %s", Table(model), alphabet)
+	}
+	width := ulidWidth(base)
+	if length < width+4 || length > ulidMax {
+		return "", 0, fmt.Errorf("ulid length of %s must be between %d and %d", Table(model), width+4, ulidMax)
+	}
+	return alphabet, length, nil
+}
+
+// ulidWidth is the count of characters that
+// the time (48 bits) takes in the base
+func ulidWidth(base int) int {
+	return int(math.Ceil(48 / math.Log2(float64(base))))
+}
+
+// newULID renders the milliseconds of the time (48 bits) in
+// the alphabet, padded to a fixed width, followed by random
+// characters up to the given length. The alphabet and length
+// are those validated by ulidSpec
+func newULID(at time.Time, alphabet string, length int) string {
+	base := len(alphabet)
+	width := ulidWidth(base)
+
+	out := make([]byte, length)
+	ms := uint64(at.UnixNano()/int64(time.Millisecond)) & (1<<48 - 1)
+	for i := width - 1; i >= 0; i-- {
+		out[i] = alphabet[ms%uint64(base)]
+		ms /= uint64(base)
+	}
+
+	max := big.NewInt(int64(base))
+	for i := width; i < length; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		out[i] = alphabet[n.Int64()]
+	}
+	return string(out)
+}
+
+// newUUID7 returns a version 7 uuid: 48 bits of milliseconds,
+// followed by the version, variant and random bits
+func newUUID7(at time.Time) string {
+	var u [16]byte
+	if _, err := rand.Read(u[6:]); err != nil {
+		panic(err)
+	}
+	ms := uint64(at.UnixNano() / int64(time.Millisecond))
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], ms<<16)
+	copy(u[:6], ts[:6])
+	u[6] = u[6]&0x0f | 0x70
+	u[8] = u[8]&0x3f | 0x80
+
+	h := hex.EncodeToString(u[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// assignUID generates the uid of the row to be inserted (unless
+// the data has one already), and sets it upon the model too, so
+// that it is known before the row is read back
+func assignUID(addr interface{}, data map[string]string) error {
+	if data["uid"] != "" {
+		return nil
+	}
+	uid, ok, err := newUID(addr)
+	if !ok || err != nil {
+		return err
+	}
+	data["uid"] = uid
+
+	v := reflect.ValueOf(addr)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if f := v.FieldByName("UID"); f.IsValid() && f.CanSet() && f.Kind() == reflect.String {
+		f.SetString(uid)
+	}
+	return nil
+}
+
+// uidCreate generates the uid of rows created by gorm,
+// unless they have one already
+func uidCreate(scope *gorm.Scope) {
+	if scope.HasError() {
+		return
+	}
+	f, ok := scope.FieldByName("UID")
+	if !ok || !f.IsBlank {
+		return
+	}
+	uid, ok, err := newUID(scope.Value)
+	if err != nil {
+		scope.Err(err)
+		return
+	}
+	if ok {
+		scope.Err(f.Set(uid))
+	}
+}
@@ -0,0 +1,113 @@
+package dorm
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewULID(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	a := newULID(at, ulidAlphabet, ulidLength)
+	assert.Len(t, a, 26)
+	assert.Regexp(t, "^[0-9A-HJKMNP-TV-Z]{26}$", a)
+	assert.Equal(t, a[:10], newULID(at, ulidAlphabet, ulidLength)[:10])
+	assert.True(t, a < newULID(at.Add(time.Millisecond), ulidAlphabet, ulidLength))
+
+	b := newULID(at, "0123456789abcdefghijklmnopqrstuvwxyz", 20)
+	assert.Len(t, b, 20)
+	assert.True(t, b < newULID(at.Add(time.Second), "0123456789abcdefghijklmnopqrstuvwxyz", 20))
+}
+
+func TestULIDSpec(t *testing.T) {
+	type plain struct {
+		PKey
+		ULID
+	}
+	type short struct {
+		PKey
+		ULID `alphabet:"0123456789abcdefghijklmnopqrstuvwxyz" length:"20"`
+	}
+	type unsorted struct {
+		PKey
+		ULID `alphabet:"zyx"`
+	}
+	type tiny struct {
+		PKey
+		ULID `length:"12"`
+	}
+	type huge struct {
+		PKey
+		ULID `length:"40"`
+	}
+	type nan struct {
+		PKey
+		ULID `length:"long"`
+	}
+
+	a, n, err := ulidSpec(&plain{})
+	assert.Nil(t, err)
+	assert.Equal(t, ulidAlphabet, a)
+	assert.Equal(t, ulidLength, n)
+
+	_, n, err = ulidSpec(&short{})
+	assert.Nil(t, err)
+	assert.Equal(t, 20, n)
+
+	for _, m := range []interface{}{&unsorted{}, &tiny{}, &huge{}, &nan{}} {
+		_, _, err = ulidSpec(m)
+		assert.NotNil(t, err)
+		assert.NotNil(t, checkModel(m))
+		assert.NotNil(t, assignUID(m, map[string]string{}))
+	}
+}
+
+func TestNewUUID7(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	u := newUUID7(at)
+	assert.Regexp(t, regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$"), u)
+	assert.True(t, u < newUUID7(at.Add(time.Millisecond)))
+}
+
+func TestAssignUID(t *testing.T) {
+	type ticket struct {
+		PKey
+		ULID `length:"20"`
+	}
+
+	m := ticket{}
+	data := map[string]string{}
+	assignUID(&m, data)
+	assert.Len(t, data["uid"], 20)
+	assert.Equal(t, data["uid"], m.UID)
+
+	data = map[string]string{"uid": "kept"}
+	assignUID(&ticket{}, data)
+	assert.Equal(t, "kept", data["uid"])
+}
+
+func TestPopulateUID(t *testing.T) {
+	type token struct {
+		PKey
+		ULID
+	}
+	dbo, f := newFakeDB(t)
+	assert.Nil(t, PopulateDBE(dbo, &token{}, &token{}, &token{ULID: ULID{UID: "given"}}))
+
+	uids := []interface{}{}
+	stmts, args := f.sent()
+	for i, s := range stmts {
+		if strings.HasPrefix(strings.TrimSpace(s), "INSERT INTO `token`") {
+			assert.Contains(t, s, "`uid`")
+			uids = append(uids, args[i][0])
+		}
+	}
+	assert.Len(t, uids, 3)
+	assert.Len(t, uids[0], 26)
+	assert.NotEqual(t, uids[0], uids[1])
+	assert.Equal(t, "given", uids[2])
+}
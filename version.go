@@ -0,0 +1,148 @@
+package dorm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// Kinds of objects whose definition is versioned
+// in the schema_object table
+const (
+	ObjectTrigger  = "trigger"
+	ObjectFunction = "function"
+	ObjectHistory  = "history"
+	ObjectRecord   = "record"
+)
+
+// SchemaObject records a database object (trigger, function,
+// history table or initial record) that BuildSchema has generated,
+// along with the checksum of its definition. Objects whose
+// checksum has not changed are not generated again
+type SchemaObject struct {
+	PKey
+
+	Kind     string `sql:"TYPE:varchar(16);not null" json:"kind" unique:"idx_schema_object(kind,name)"`
+	Name     string `sql:"TYPE:varchar(191);not null" json:"name"`
+	Entity   string `sql:"TYPE:varchar(96);not null;DEFAULT:''" json:"entity"`
+	Checksum string `sql:"TYPE:char(64);not null" json:"checksum"`
+
+	TimedLite
+}
+
+// checksum returns the hex encoded sha256 of the definition
+func checksum(def string) string {
+	sum := sha256.Sum256([]byte(def))
+	return hex.EncodeToString(sum[:])
+}
+
+var triggerNameRegex = regexp.MustCompile("(?is)(?:^|;)\\s*CREATE\\s+(?:DEFINER\\s*=\\s*\\S+\\s+)?TRIGGER\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?`?([\\w$.]+)`?")
+
+// triggerName extracts the trigger name from a CREATE TRIGGER
+// statement, which (on postgres) may follow the function that
+// the trigger executes. It is empty for any other statement
+func triggerName(sql string) string {
+	m := triggerNameRegex.FindStringSubmatch(sql)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// setupObjectTable creates the schema_object table (if needed)
+// and loads the checksums recorded in it
+func (b *schemaBuilder) setupObjectTable() {
+	obj := &SchemaObject{}
+	tbl := Table(obj)
+
+	b.versions = map[string]string{}
+	b.entities = map[string]string{}
+
+	if !b.hasTable(tbl) {
+		b.autoMigrate(obj)
+		b.setupUniqueIndexes(obj)
+		return
+	}
+
+	var rows []SchemaObject
+	err := b.dbo.Raw("SELECT kind, name, entity, checksum FROM " + tbl).Scan(&rows).Error
+	if err != nil {
+		panic(err)
+	}
+	for _, r := range rows {
+		b.versions[r.Kind+":"+r.Name] = r.Checksum
+		b.entities[r.Kind+":"+r.Name] = r.Entity
+	}
+}
+
+// isCurrent tells if the object was generated
+// with the same definition (checksum) earlier
+func (b *schemaBuilder) isCurrent(kind string, name string, sum string) bool {
+	return b.versions[kind+":"+name] == sum
+}
+
+// record saves the checksum of the object
+// that has just been generated
+func (b *schemaBuilder) record(entity string, phase string, kind string, name string, sum string) {
+	b.exec(entity, phase, b.sql.upsert(Table(SchemaObject{}),
+		[]string{"kind", "name", "entity", "checksum", "updated_at"},
+		[]string{sqlLiteral(kind), sqlLiteral(name), sqlLiteral(entity), sqlLiteral(sum), "NOW()"},
+		[]string{"kind", "name"},
+		[]string{"entity", "checksum", "updated_at"}))
+	b.versions[kind+":"+name] = sum
+	b.entities[kind+":"+name] = entity
+}
+
+// forget removes the record of an object
+// that has just been dropped
+func (b *schemaBuilder) forget(entity string, phase string, kind string, name string) {
+	b.exec(entity, phase, "DELETE FROM "+Table(SchemaObject{})+" WHERE kind = "+sqlLiteral(kind)+" AND name = "+sqlLiteral(name))
+	delete(b.versions, kind+":"+name)
+	delete(b.entities, kind+":"+name)
+}
+
+// trigger creates the trigger defined by the given statement.
+// A trigger that exists with the same definition is skipped,
+// and one whose definition has changed is replaced. Statements
+// that do not create a trigger are run as they are
+func (b *schemaBuilder) trigger(table string, phase string, sql string) {
+	name := triggerName(sql)
+	if name == "" {
+		b.exec(table, phase, sql)
+		return
+	}
+
+	sum := checksum(sql)
+	if b.isCurrent(ObjectTrigger, name, sum) && b.sql.hasTrigger(b.dbo, name) {
+		return
+	}
+
+	// mysql cannot replace a trigger in place
+	b.exec(table, phase, b.sql.dropTrigger(name, table))
+	b.exec(table, phase, sql)
+	b.record(table, phase, ObjectTrigger, name, sum)
+}
+
+// function creates (or replaces) the stored function,
+// unless it exists with the same definition
+func (b *schemaBuilder) function(name string, sql string) {
+	sum := checksum(sql)
+	if b.isCurrent(ObjectFunction, name, sum) && b.sql.hasFunction(b.dbo, name) {
+		return
+	}
+
+	b.exec(name, PhaseFunction, b.sql.dropFunction(name))
+	b.exec(name, PhaseFunction, sql)
+	b.record(name, PhaseFunction, ObjectFunction, name, sum)
+}
+
+// columnsChecksum is the checksum of the column definitions
+// of a table, in their order
+func columnsChecksum(cols []showColumn) string {
+	defs := make([]string, len(cols))
+	for i, c := range cols {
+		defs[i] = strings.TrimSpace(c.definition())
+	}
+	return checksum(strings.Join(defs, "\n"))
+}
@@ -0,0 +1,31 @@
+package dorm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTriggerName(t *testing.T) {
+	assert.Equal(t, "product_uid10_bfr_insert", triggerName(`CREATE TRIGGER product_uid10_bfr_insert BEFORE INSERT ON product FOR EACH ROW`))
+	assert.Equal(t, "audit", triggerName("\n\t  create trigger `audit` AFTER UPDATE ON product"))
+	assert.Equal(t, "audit", triggerName("CREATE DEFINER=`root`@`%` TRIGGER audit AFTER UPDATE ON product"))
+	assert.Equal(t, "", triggerName("ALTER TABLE product ENGINE = MyISAM"))
+	assert.Equal(t, "", triggerName("DROP TRIGGER IF EXISTS audit"))
+}
+
+func TestColumnsChecksum(t *testing.T) {
+	deflt := "0"
+	a := []showColumn{{Name: "id", Type: "int unsigned", Null: "NO"}, {Name: "n", Type: "int", Default: &deflt}}
+	b := []showColumn{{Name: "n", Type: "int", Default: &deflt}, {Name: "id", Type: "int unsigned", Null: "NO"}}
+
+	assert.Equal(t, columnsChecksum(a), columnsChecksum(a))
+	assert.NotEqual(t, columnsChecksum(a), columnsChecksum(b))
+	assert.Len(t, columnsChecksum(a), 64)
+}
+
+func TestTriggerNamePostgres(t *testing.T) {
+	sql := pgTrigger("product_timed_bfr_update", "BEFORE UPDATE", "BEGIN RETURN NEW; END")
+	assert.Equal(t, "product_timed_bfr_update", triggerName(strings.Replace(sql, "<<Table>>", "product", -1)))
+}
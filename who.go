@@ -1,12 +1,23 @@
 package dorm
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
+	"github.com/rightjoin/fig"
 	"github.com/rightjoin/rutl/ip"
 )
 
@@ -24,43 +35,259 @@ func WhoStr(r *http.Request) string {
 
 func WhoMap(r *http.Request) map[string]interface{} {
 
+	policy := whoPolicy()
 	who := map[string]interface{}{}
 
 	// store general request info like ip and port
 	rq := map[string]interface{}{}
 
-	// store ip (format 122.323.23.23:92839)
-	colon := strings.LastIndex(r.RemoteAddr, ":")
-	if ip := r.RemoteAddr[0:colon]; strings.HasPrefix(ip, "[") && strings.HasSuffix(ip, "]") {
-		rq["ip"] = ip[1 : len(ip)-1]
-	} else {
-		rq["ip"] = ip
+	// store ip (format 122.323.23.23:92839), or the raw
+	// address as the ip when it has no port
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host, port = r.RemoteAddr, ""
 	}
-	rq["p"] = r.RemoteAddr[colon+1:]
+	rq["ip"] = host
+	rq["p"] = port
 	rq["raw"] = r.RemoteAddr
-	rq["u"] = r.URL.String()
+	rq["u"] = policy.url(r.URL)
 	rq["m"] = r.Method
 	who["req"] = rq
 
-	// store all headers except cookie
+	// store headers, as the policy allows (cookies
+	// are stored by themselves)
 	hd := map[string]interface{}{}
 	for key, arr := range r.Header {
-		if key != "Cookie" {
-			hd[key] = strings.Join(arr, ";")
+		if key == "Cookie" {
+			continue
+		}
+		if val, ok := policy.Headers.apply(policy.hashKey(), key, strings.Join(arr, ";")); ok {
+			hd[key] = val
 		}
 	}
 	who["headers"] = hd
 
-	// store cookie values
+	// store cookie values, as the policy allows
 	ck := map[string]interface{}{}
 	for _, c := range r.Cookies() {
-		ck[c.Name] = c.Value
+		if val, ok := policy.Cookies.apply(policy.hashKey(), c.Name, c.Value); ok {
+			ck[c.Name] = val
+		}
 	}
 	who["cookies"] = ck
 
+	policy.limit(who, policy.MaxSize)
 	return who
 }
 
+// WhoRules redact the values of named headers, cookies or url
+// parameters. Names are matched regardless of case, and may be
+// patterns (such as *token*). A value is dropped unless allowed
+// (an empty Allow allows all) or if denied; else it is hashed
+// (hmac sha256, keyed by the HashKey of the policy) or masked
+// (all but the last 4 characters, or all of values of 8 or
+// fewer, lest half of them show) if named so
+type WhoRules struct {
+	Allow []string
+	Deny  []string
+	Hash  []string
+	Mask  []string
+}
+
+// WhoPolicy is the redaction of the request that WhoMap (and
+// WhoStr) record in the who of every write and history row.
+// MaxSize limits the who, as json: cookies, and then headers,
+// are dropped (and then the url is cut short) to fit. It also
+// limits the Who of WhoMiddleware, actor and all. HashKey
+// keys the hashes of values; without one, a key generated for
+// the process is used, so hashes only match within the process
+type WhoPolicy struct {
+	Headers WhoRules
+	Cookies WhoRules
+	Params  WhoRules
+	MaxSize int
+	HashKey []byte
+}
+
+// WhoRedaction overrides the policy read from config
+var WhoRedaction *WhoPolicy
+
+var (
+	configWhoPolicy WhoPolicy
+	configWhoOnce   sync.Once
+
+	processHashKey  []byte
+	processHashOnce sync.Once
+)
+
+// credentials, which are never stored by default
+var whoSecrets = []string{"*token*", "*secret*", "*password*", "*passwd*", "*api-key*", "*api_key*", "*apikey*", "*signature*"}
+
+// ConfigWhoPolicy reads the policy from config, with defaults
+// that keep credentials out of the who:
+// database:
+//		who:
+//			headers, cookies, params:
+//				allow, deny, hash, mask: lists of names
+//			max_size: defaults to 8192
+//			hash_key: key of hashes (base64)
+// Headers Authorization, Proxy-Authorization and Set-Cookie (and
+// those named like tokens, secrets or keys) are denied, cookies
+// are hashed, and url parameters named like credentials are masked
+func ConfigWhoPolicy() WhoPolicy {
+	rules := func(name string, deny []string, hash []string, mask []string) WhoRules {
+		key := "database.who." + name
+		return WhoRules{
+			Allow: fig.StringSliceOr(nil, key, "allow"),
+			Deny:  fig.StringSliceOr(deny, key, "deny"),
+			Hash:  fig.StringSliceOr(hash, key, "hash"),
+			Mask:  fig.StringSliceOr(mask, key, "mask"),
+		}
+	}
+	p := WhoPolicy{
+		Headers: rules("headers", append([]string{"authorization", "proxy-authorization", "set-cookie", "x-*-key"}, whoSecrets...), nil, nil),
+		Cookies: rules("cookies", nil, []string{"*"}, nil),
+		Params:  rules("params", nil, nil, append([]string{"key", "code", "sig"}, whoSecrets...)),
+		MaxSize: fig.IntOr(8192, "database.who.max_size"),
+	}
+	if hk := fig.StringOr("", "database.who.hash_key"); hk != "" {
+		key, err := base64.StdEncoding.DecodeString(hk)
+		if err != nil {
+			panic(fmt.Sprintf("database.who.hash_key is not base64: %s", err))
+		}
+		p.HashKey = key
+	}
+	return p
+}
+
+// hashKey returns the key of hashes of the policy,
+// else the key generated for the process
+func (p WhoPolicy) hashKey() []byte {
+	if len(p.HashKey) > 0 {
+		return p.HashKey
+	}
+	processHashOnce.Do(func() {
+		processHashKey = make([]byte, 32)
+		if _, err := rand.Read(processHashKey); err != nil {
+			panic(err)
+		}
+	})
+	return processHashKey
+}
+
+func whoPolicy() WhoPolicy {
+	if WhoRedaction != nil {
+		return *WhoRedaction
+	}
+	configWhoOnce.Do(func() {
+		configWhoPolicy = ConfigWhoPolicy()
+	})
+	return configWhoPolicy
+}
+
+// matchName tells if the name matches any of the patterns
+func matchName(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns the value as the rules allow it to be
+// stored (hashed with the key), and tells if it may be
+// stored at all
+func (w WhoRules) apply(key []byte, name string, value string) (string, bool) {
+	switch {
+	case len(w.Allow) > 0 && !matchName(w.Allow, name):
+		return "", false
+	case matchName(w.Deny, name):
+		return "", false
+	case matchName(w.Hash, name):
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(value))
+		return "hmac:" + hex.EncodeToString(mac.Sum(nil)), true
+	case matchName(w.Mask, name):
+		runes := []rune(value)
+		if len(runes) <= 8 {
+			return strings.Repeat("*", len(runes)), true
+		}
+		return strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:]), true
+	}
+	return value, true
+}
+
+// url renders the url with its parameters redacted
+func (p WhoPolicy) url(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	out := *u
+	q := url.Values{}
+	for key, vals := range u.Query() {
+		for _, v := range vals {
+			if val, ok := p.Params.apply(p.hashKey(), key, v); ok {
+				q.Add(key, val)
+			}
+		}
+	}
+	out.RawQuery = q.Encode()
+	return out.String()
+}
+
+// limit drops cookies, and then headers, from the who
+// until it fits within max, and then cuts the url short
+func (p WhoPolicy) limit(who map[string]interface{}, max int) {
+	if max <= 0 {
+		return
+	}
+	size := func() int {
+		b, err := json.Marshal(who)
+		if err != nil {
+			return 0
+		}
+		return len(b)
+	}
+	for _, key := range []string{"cookies", "headers"} {
+		if size() <= max {
+			return
+		}
+		delete(who, key)
+		who["truncated"] = true
+	}
+
+	rq, ok := who["req"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	u, _ := rq["u"].(string)
+	for over := size() - max; over > 0 && u != ""; over = size() - max {
+		if over > len(u) {
+			over = len(u)
+		}
+		u = cutURL(u, len(u)-over)
+		rq["u"] = u
+		who["truncated"] = true
+	}
+}
+
+// cutURL cuts the url to at most n bytes, on the boundary
+// of a character and of a %xx escape
+func cutURL(u string, n int) string {
+	for n > 0 && n < len(u) && !utf8.RuneStart(u[n]) {
+		n--
+	}
+	for i := n - 1; i >= 0 && i >= n-2; i-- {
+		if u[i] == '%' {
+			n = i
+			break
+		}
+	}
+	return u[:n]
+}
+
 func WhoProc(script string, kv ...interface{}) string {
 	host, _ := os.Hostname()
 
@@ -0,0 +1,146 @@
+package dorm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rightjoin/fig"
+	"github.com/rightjoin/rutl/refl"
+)
+
+// Who is the actor behind a write, as recorded in the who of
+// models composed of WhosThat. Insert and Update (and Restore)
+// record the Who of the handle, from WithWho or WithContext,
+// unless the data holds a who of its own
+type Who struct {
+	ActorID   string `json:"actor_id,omitempty"`
+	ActorType string `json:"actor_type,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Service   string `json:"service,omitempty"`
+
+	// Request is the http request, as from WhoMap
+	Request map[string]interface{} `json:"request,omitempty"`
+}
+
+// String returns the who as json
+func (w Who) String() string {
+	b, err := json.Marshal(w)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+type whoContextKey struct{}
+
+// NewWhoContext returns a context that carries the who
+func NewWhoContext(ctx context.Context, who Who) context.Context {
+	return context.WithValue(ctx, whoContextKey{}, who)
+}
+
+// WhoFrom returns the who carried by the context, if any
+func WhoFrom(ctx context.Context) (Who, bool) {
+	who, ok := ctx.Value(whoContextKey{}).(Who)
+	return who, ok
+}
+
+// setting of a handle that carries the who
+const whoKey = "dorm:who"
+
+// WithWho returns a handle that records the who in its writes
+func WithWho(dbo *gorm.DB, who Who) *gorm.DB {
+	return dbo.Set(whoKey, who)
+}
+
+// WithContext returns a handle that records the who carried
+// by the context (if any) in its writes:
+// Insert(WithContext(dbo, r.Context()), &order, ...)
+func WithContext(dbo *gorm.DB, ctx context.Context) *gorm.DB {
+	who, ok := WhoFrom(ctx)
+	if !ok {
+		return dbo
+	}
+	return WithWho(dbo, who)
+}
+
+// WhoOf returns the who of the handle, if any
+func WhoOf(dbo *gorm.DB) (Who, bool) {
+	v, ok := dbo.Get(whoKey)
+	if !ok {
+		return Who{}, false
+	}
+	who, ok := v.(Who)
+	return who, ok
+}
+
+// attachWho sets the who of the handle in the data of
+// models composed of WhosThat, unless it is already set
+func attachWho(dbo *gorm.DB, addr interface{}, data map[string]string) {
+	if _, ok := data["who"]; ok || !refl.ComposedOf(addr, WhosThat{}) {
+		return
+	}
+	if who, ok := WhoOf(dbo); ok {
+		data["who"] = who.String()
+	}
+}
+
+// WhoMiddleware returns middleware that carries the who of each
+// request in its context. The actor (which may be nil) returns
+// the id and type of the actor of the request, as from its
+// session. The request id is read from the X-Request-Id header
+// (database.who.request_header), or else generated, and the
+// service is database.who.service (defaults to the binary's name)
+func WhoMiddleware(actor func(r *http.Request) (id string, typ string)) func(http.Handler) http.Handler {
+	header := fig.StringOr("X-Request-Id", "database.who.request_header")
+	service := fig.StringOr(filepath.Base(os.Args[0]), "database.who.service")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			who := whoOfRequest(r, header, service)
+			if actor != nil {
+				who.ActorID, who.ActorType = actor(r)
+			}
+			whoPolicy().fit(&who)
+			next.ServeHTTP(w, r.WithContext(NewWhoContext(r.Context(), who)))
+		})
+	}
+}
+
+// fit limits the who to MaxSize, as its request is by WhoMap
+// but for the room the other fields take. The request is
+// dropped if even that does not fit
+func (p WhoPolicy) fit(who *Who) {
+	if p.MaxSize <= 0 || len(who.String()) <= p.MaxSize {
+		return
+	}
+	rest := *who
+	rest.Request = nil
+	room := p.MaxSize - len(rest.String()) - len(`,"request":`)
+	if who.Request != nil && room > 0 {
+		p.limit(who.Request, room)
+	}
+	if len(who.String()) > p.MaxSize {
+		who.Request = nil
+	}
+}
+
+func whoOfRequest(r *http.Request, header string, service string) Who {
+	who := Who{
+		RequestID: r.Header.Get(header),
+		Service:   service,
+		Request:   WhoMap(r),
+	}
+	if who.RequestID == "" {
+		who.RequestID = newUUID7(time.Now())
+	}
+	if rq, ok := who.Request["req"].(map[string]interface{}); ok {
+		who.IP, _ = rq["ip"].(string)
+	}
+	return who
+}
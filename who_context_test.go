@@ -0,0 +1,73 @@
+package dorm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWhoContext(t *testing.T) {
+	_, ok := WhoFrom(context.Background())
+	assert.False(t, ok)
+
+	ctx := NewWhoContext(context.Background(), Who{ActorID: "42", ActorType: "user"})
+	who, ok := WhoFrom(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "42", who.ActorID)
+
+	doc := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal([]byte(who.String()), &doc))
+	assert.Equal(t, map[string]interface{}{"actor_id": "42", "actor_type": "user"}, doc)
+}
+
+func TestWhoMiddleware(t *testing.T) {
+	var who Who
+	handler := WhoMiddleware(func(r *http.Request) (string, string) {
+		return "7", "admin"
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		who, _ = WhoFrom(r.Context())
+	}))
+
+	r := httptest.NewRequest("POST", "/orders", nil)
+	r.Header.Set("X-Request-Id", "abc")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "7", who.ActorID)
+	assert.Equal(t, "admin", who.ActorType)
+	assert.Equal(t, "abc", who.RequestID)
+	assert.Equal(t, "192.0.2.1", who.IP)
+	assert.NotEmpty(t, who.Service)
+	assert.NotNil(t, who.Request)
+
+	// request ids are generated when missing
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Len(t, who.RequestID, 36)
+}
+
+func TestWhoMiddlewareMaxSize(t *testing.T) {
+	WhoRedaction = &WhoPolicy{MaxSize: 400}
+	defer func() { WhoRedaction = nil }()
+
+	var who Who
+	handler := WhoMiddleware(func(r *http.Request) (string, string) {
+		return strings.Repeat("7", 100), "admin"
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		who, _ = WhoFrom(r.Context())
+	}))
+
+	// the url is cut to make room for the actor and service
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders?q="+strings.Repeat("x", 1000), nil))
+	assert.True(t, len(who.String()) <= 400, len(who.String()))
+	assert.Equal(t, true, who.Request["truncated"])
+	assert.Len(t, who.ActorID, 100)
+
+	// and the request is dropped if even that does not fit
+	WhoRedaction = &WhoPolicy{MaxSize: 250}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders", nil))
+	assert.True(t, len(who.String()) <= 250, len(who.String()))
+	assert.Nil(t, who.Request)
+}
@@ -0,0 +1,126 @@
+package dorm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWhoRules(t *testing.T) {
+	w := WhoRules{Deny: []string{"*token*"}, Hash: []string{"sid"}, Mask: []string{"card"}}
+	key := []byte("key")
+
+	_, ok := w.apply(key, "X-Auth-Token", "abc")
+	assert.False(t, ok)
+
+	val, ok := w.apply(key, "SID", "abc")
+	assert.True(t, ok)
+	assert.Equal(t, "hmac:9c196e32dc0175f86f4b1cb89289d6619de6bee699e4c378e68309ed97a1a6ab", val)
+	other, _ := w.apply([]byte("other"), "SID", "abc")
+	assert.NotEqual(t, val, other)
+
+	val, _ = w.apply(key, "card", "4111111111111111")
+	assert.Equal(t, "************1111", val)
+	val, _ = w.apply(key, "card", "1234")
+	assert.Equal(t, "****", val)
+	val, _ = w.apply(key, "card", "12345678")
+	assert.Equal(t, "********", val)
+	val, _ = w.apply(key, "card", "jöhn-döe-ünö")
+	assert.Equal(t, "********-ünö", val)
+
+	val, _ = w.apply(key, "Accept", "text/html")
+	assert.Equal(t, "text/html", val)
+
+	// allow list drops all else
+	w = WhoRules{Allow: []string{"user-agent"}, Deny: []string{"user-agent"}}
+	_, ok = w.apply(key, "Accept", "text/html")
+	assert.False(t, ok)
+	_, ok = w.apply(key, "User-Agent", "curl")
+	assert.False(t, ok)
+}
+
+func TestWhoMapDefaults(t *testing.T) {
+	policy := ConfigWhoPolicy()
+	WhoRedaction = &policy
+	defer func() { WhoRedaction = nil }()
+
+	r := httptest.NewRequest("GET", "/orders?id=7&access_token=secretvalue", nil)
+	r.Header.Set("Authorization", "Bearer xyz")
+	r.Header.Set("X-Api-Key", "xyz")
+	r.Header.Set("User-Agent", "curl")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "xyz"})
+
+	who := WhoMap(r)
+	hd := who["headers"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"User-Agent": "curl"}, hd)
+
+	ck := who["cookies"].(map[string]interface{})
+	assert.True(t, strings.HasPrefix(ck["session"].(string), "hmac:"))
+
+	u := who["req"].(map[string]interface{})["u"].(string)
+	assert.NotContains(t, u, "secretvalue")
+	assert.Contains(t, u, "id=7")
+}
+
+func TestWhoMapMaxSize(t *testing.T) {
+	WhoRedaction = &WhoPolicy{MaxSize: 300}
+	defer func() { WhoRedaction = nil }()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", strings.Repeat("a", 100))
+	r.AddCookie(&http.Cookie{Name: "big", Value: strings.Repeat("b", 300)})
+
+	who := WhoMap(r)
+	assert.Nil(t, who["cookies"])
+	assert.NotNil(t, who["headers"])
+	assert.Equal(t, true, who["truncated"])
+
+	b, _ := json.Marshal(who)
+	assert.True(t, len(b) <= 300)
+}
+
+func TestWhoMapLongURL(t *testing.T) {
+	WhoRedaction = &WhoPolicy{MaxSize: 300}
+	defer func() { WhoRedaction = nil }()
+
+	r := httptest.NewRequest("GET", "/orders?q="+strings.Repeat("x", 1000), nil)
+	r.Header.Set("User-Agent", "curl")
+
+	who := WhoMap(r)
+	assert.Nil(t, who["headers"])
+	assert.Equal(t, true, who["truncated"])
+	assert.True(t, strings.HasPrefix(who["req"].(map[string]interface{})["u"].(string), "/orders?q=xxx"))
+
+	b, _ := json.Marshal(who)
+	assert.True(t, len(b) <= 300, len(b))
+}
+
+func TestWhoMapRemoteAddr(t *testing.T) {
+	for addr, want := range map[string][2]string{
+		"192.0.2.1:1234":   {"192.0.2.1", "1234"},
+		"[2001:db8::1]:80": {"2001:db8::1", "80"},
+		"192.0.2.1":        {"192.0.2.1", ""},
+		"@":                {"@", ""},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		rq := WhoMap(r)["req"].(map[string]interface{})
+		assert.Equal(t, want[0], rq["ip"], addr)
+		assert.Equal(t, want[1], rq["p"], addr)
+		assert.Equal(t, addr, rq["raw"], addr)
+	}
+}
+
+func TestCutURL(t *testing.T) {
+	assert.Equal(t, "/a?q=x", cutURL("/a?q=x%20y", 6))
+	assert.Equal(t, "/a?q=x", cutURL("/a?q=x%20y", 7))
+	assert.Equal(t, "/a?q=x", cutURL("/a?q=x%20y", 8))
+	assert.Equal(t, "/a?q=x%20", cutURL("/a?q=x%20y", 9))
+	assert.Equal(t, "/ü", cutURL("/üö", 4))
+	assert.Equal(t, "/ü", cutURL("/üö", 3))
+	assert.Equal(t, "/", cutURL("/üö", 2))
+}